@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+// The audit log (AuditLog) gets a JSON line for every change rotator makes
+// to the oncall calendar or OpsGenie, saying who ran it with what flags,
+// and why the change was made.
+type auditEntry struct {
+	Time     time.Time  `json:"time"`
+	Run      string     `json:"run,omitempty"`
+	User     string     `json:"user"`
+	Args     []string   `json:"args"`
+	Rotation string     `json:"rotation,omitempty"`
+	Target   string     `json:"target"` // "calendar" or "opsgenie"
+	Role     string     `json:"role"`   // "onduty", "backup" or "cover"
+	Day      string     `json:"day"`
+	Old      string     `json:"old,omitempty"`
+	New      string     `json:"new"`
+	Reason   string     `json:"reason,omitempty"`
+	Start    *time.Time `json:"start,omitempty"`
+	End      *time.Time `json:"end,omitempty"`
+	Alias    string     `json:"alias,omitempty"`
+	Failed   bool       `json:"failed,omitempty"`
+}
+
+func writeAudit(entry auditEntry) {
+	if config.AuditLog == "" {
+		return
+	}
+	entry.Time = time.Now()
+	entry.Run = runID
+	entry.User = invokingUser()
+	entry.Args = os.Args[1:]
+	entry.Rotation = stateKey()
+	// Planned changes are logged when (and if) they're applied: the entry
+	// goes with the last change planned so far, so it's logged once that
+	// (and everything before it) has been made.
+	if activePlan != nil {
+		if n := len(activePlan.Ops); n > 0 {
+			op := activePlan.Ops[n-1]
+			op.Audit = append(op.Audit, entry)
+		}
+		return
+	}
+	appendAudit(entry)
+}
+
+func appendAudit(entry auditEntry) {
+	if config.AuditLog == "" || *flagDryRun {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Printf("Error writing audit log: %s\n", err)
+		return
+	}
+	f, err := os.OpenFile(config.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		fmt.Printf("Error writing audit log: %s\n", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		fmt.Printf("Error writing audit log: %s\n", err)
+	}
+}
+
+func invokingUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// auditOncall logs a change of day's oncaller (or backup) in the calendar.
+func auditOncall(day time.Time, role string, previous oncallPerson, victim oncallPerson, reason string) {
+	writeAudit(auditEntry{
+		Target: "calendar",
+		Role:   role,
+		Day:    dateFormat(day),
+		Old:    previous.Code,
+		New:    victim.Code,
+		Reason: reason,
+	})
+}
+
+// changeReason works out why previous no longer has day: "swap" for fixed
+// days, otherwise "unavailable" (away), "holiday" (their regional holiday,
+// or the rota carrying on over a weekend or public holiday), "overloaded"
+// (over their monthly limits), "blocked" (their own settings),
+// "unrestrict", or just "rotation".
+func changeReason(cal CalendarBackend, day time.Time, previous oncallPerson, fixed bool) string {
+	switch {
+	case fixed:
+		return "swap"
+	case previous.Code == "":
+		return "new"
+	case *flagUnrestrict:
+		return "unrestrict"
+	}
+	if away, err := getAwayList(cal, day); err == nil && isListed(strings.ToLower(previous.Code), away) {
+		return "unavailable"
+	}
+	if isRegionalHoliday(previous, day) || !isWorkday(day) {
+		return "holiday"
+	}
+	if r, ok := restrictions.Detail[previous.Code]; ok && restrictions.Month == day.Month() &&
+		restrictions.Year == day.Year() {
+		// Their load includes the day being taken off them, which
+		// doesn't count against them.
+		days, weekends := r.DaysBooked, r.WeekendsBooked
+		if wasOncall(previous.Code, day) {
+			days--
+			if isWeekend(day) {
+				weekends--
+			}
+		}
+		if days >= personLimit(config.MaxDaysPerMonth, previous) ||
+			(isWeekend(day) && weekends >= personLimit(config.MaxWeekendsPerMonth, previous)) {
+			return "overloaded"
+		}
+	}
+	if personalBlock(previous, day) != "" {
+		return "blocked"
+	}
+	return "rotation"
+}
+
+// overrideReason is the reason logged for an OpsGenie override giving day
+// to victim instead of previous (the calendar's oncaller before the run),
+// worked out before the calendar changes. An override that just restates
+// the calendar has none.
+func overrideReason(cal CalendarBackend, day time.Time, previous oncallPerson, victim oncallPerson) string {
+	if previous.Code == victim.Code {
+		return ""
+	}
+	return changeReason(cal, day, previous, false)
+}
+
+// historyCommand handles "history [CODE] [FROM [TO]]", listing the audit
+// log, optionally only for one person and/or a range of days (and with
+// -rotation, for one rotation).
+func historyCommand(args []string) error {
+	if config.AuditLog == "" {
+		return errors.New("no auditlog configured")
+	}
+	var code, from, to string
+	for _, arg := range args {
+		if _, err := parseDate(arg); err == nil {
+			if from == "" {
+				from = arg
+			} else {
+				to = arg
+			}
+			continue
+		}
+		if code != "" {
+			return errors.New("usage: history [CODE] [FROM [TO]]")
+		}
+		code = strings.ToLower(arg)
+	}
+	if to == "" {
+		to = from
+	}
+	email := ""
+	if person, ok := oncallersByCode[code]; ok {
+		email = person.Email
+	}
+
+	f, err := os.Open(config.AuditLog)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if *rotationName != "" && e.Rotation != *rotationName &&
+			!strings.HasPrefix(e.Rotation, *rotationName+"/") {
+			continue
+		}
+		if from != "" && (e.Day < from || e.Day > to) {
+			continue
+		}
+		if code != "" && strings.ToLower(e.Old) != code && strings.ToLower(e.New) != code &&
+			(email == "" || e.New != email) {
+			continue
+		}
+		fmt.Println(formatAudit(e))
+	}
+	return scanner.Err()
+}
+
+func formatAudit(e auditEntry) string {
+	line := fmt.Sprintf("%s %s %s %s", e.Day, e.Target, e.Role, e.New)
+	if e.Old != "" {
+		line += " (was " + e.Old + ")"
+	}
+	if e.Start != nil && e.End != nil {
+		line += fmt.Sprintf(" %s-%s", e.Start.Format("2006-01-02T15:04"), e.End.Format("2006-01-02T15:04"))
+	}
+	if e.Reason != "" {
+		line += " reason=" + e.Reason
+	}
+	if e.Failed {
+		line += " FAILED"
+	}
+	if e.Rotation != "" {
+		line += " rotation=" + e.Rotation
+	}
+	return line + fmt.Sprintf(" by %s at %s [%s]", e.User,
+		e.Time.In(rotaLocation).Format("2006-01-02 15:04"), strings.Join(e.Args, " "))
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/calendar/v3"
+)
+
+// How long to wait for the browser to come back with an authorization.
+var authTimeout = 5 * time.Minute
+
+// SecretFile is either an OAuth client ("installed application") secret,
+// authorized once in a browser with the token kept in TokenFile, or a
+// service account key. A service account needs no browser at all: with
+// domain-wide delegation it acts as ImpersonateUser, otherwise as itself
+// (so the calendars have to be shared with it). isServiceAccount tells
+// which it is.
+func isServiceAccount(secret []byte) bool {
+	var key struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(secret, &key) == nil && key.Type == "service_account"
+}
+
+func serviceAccountClient(ctx context.Context, secret []byte, subject string) (*http.Client, error) {
+	jwtConfig, err := google.JWTConfigFromJSON(secret, calendar.CalendarScope)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse service account file: %v", err)
+	}
+	jwtConfig.Subject = subject
+	return jwtConfig.Client(ctx), nil
+}
+
+// authCodeFromBrowser has the user authorize rotator in a browser, which
+// then comes back to a listener on the loopback interface with the code.
+// On a machine without a browser, the link can be opened elsewhere and the
+// address it ends up at (which won't load there) pasted in instead.
+func authCodeFromBrowser(config *oauth2.Config) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	config.RedirectURL = "http://" + l.Addr().String() + "/"
+	state := randomID(16)
+
+	codes := make(chan string, 1)
+	errs := make(chan error, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, err := codeFromQuery(r.URL.Query(), state)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			sendErr(errs, err)
+			return
+		}
+		fmt.Fprintln(w, "rotator is authorized, you can close this window.")
+		sendCode(codes, code)
+	})}
+	go server.Serve(l)
+	defer server.Close()
+
+	authURL := config.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.ApprovalForce)
+	fmt.Printf("Go to the following link in your browser:\n%v\n", authURL)
+	fmt.Println("If the browser is on another machine, paste the address it ends up at here.")
+	go func() {
+		// Without a terminal (systemd, a container, </dev/null) stdin is
+		// simply at its end, and it's up to the browser.
+		for {
+			line, err := readLine(os.Stdin)
+			if strings.TrimSpace(line) != "" {
+				code, err := pastedCode(line, state)
+				if err != nil {
+					sendErr(errs, err)
+					return
+				}
+				sendCode(codes, code)
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case code := <-codes:
+		return code, nil
+	case err := <-errs:
+		return "", err
+	case <-time.After(authTimeout):
+		return "", errors.New("no authorization received")
+	}
+}
+
+// readLine reads a line from r a byte at a time, so as not to take any
+// of what comes after it.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				return string(line), nil
+			}
+			line = append(line, b[0])
+		}
+		if err != nil {
+			return string(line), err
+		}
+	}
+}
+
+// pastedCode takes the code from the address the browser was sent back
+// to, or a bare code.
+func pastedCode(line string, state string) (string, error) {
+	line = strings.TrimSpace(line)
+	if !strings.Contains(line, "?") {
+		return line, nil
+	}
+	u, err := url.Parse(line)
+	if err != nil {
+		return "", fmt.Errorf("unable to read authorization code: %v", err)
+	}
+	return codeFromQuery(u.Query(), state)
+}
+
+func codeFromQuery(query url.Values, state string) (string, error) {
+	if e := query.Get("error"); e != "" {
+		return "", fmt.Errorf("authorization failed: %s", e)
+	}
+	if query.Get("state") != state {
+		return "", errors.New("authorization for some other request")
+	}
+	if query.Get("code") == "" {
+		return "", errors.New("no authorization code")
+	}
+	return query.Get("code"), nil
+}
+
+func sendCode(codes chan string, code string) {
+	select {
+	case codes <- code:
+	default:
+	}
+}
+
+func sendErr(errs chan error, err error) {
+	select {
+	case errs <- err:
+	default:
+	}
+}
+
+// savingTokenSource writes every new token it's handed to file, so that
+// a refreshed token (and with it the refresh token) survives a restart.
+type savingTokenSource struct {
+	base oauth2.TokenSource
+	file string
+
+	mu   sync.Mutex
+	last string
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.base.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tok.AccessToken != s.last {
+		s.last = tok.AccessToken
+		if *flagDebug {
+			fmt.Printf("Token refreshed, saving to %s\n", s.file)
+		}
+		if err := saveToken(s.file, tok); err != nil {
+			fmt.Printf("Error saving refreshed token: %s\n", err)
+		}
+	}
+	return tok, nil
+}
+
+// createPrivate makes sure file exists, readable only by us (a file that
+// is already there keeps its mode).
+func createPrivate(file string) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// CalendarBackend is the storage rotator reads availability from and
+// writes oncall entries to. calendarID is whatever identifies a calendar
+// for the backend in question (OncallCalendar/AvailabilityCalendar).
+// Backends are responsible for honouring -dry_run on the write calls.
+type CalendarBackend interface {
+	// ListEvents returns all events overlapping the range [start, end).
+	ListEvents(calendarID string, start time.Time, end time.Time) ([]*calendarEvent, error)
+	InsertEvent(calendarID string, event *calendarEvent) error
+	UpdateEvent(calendarID string, event *calendarEvent) error
+	DeleteEvent(calendarID string, eventID string) error
+}
+
+// A backend-neutral calendar entry. For all-day events Start and End
+// are dates (End is exclusive, as in iCalendar) and AllDay is set.
+// Attendees is a list of email addresses.
+type calendarEvent struct {
+	ID        string
+	Summary   string
+	Start     time.Time
+	End       time.Time
+	AllDay    bool
+	Attendees []string
+}
+
+// initBackend sets up whichever calendar backend the config asks for.
+func initBackend() (CalendarBackend, error) {
+	switch config.CalendarBackend {
+	case "", "google":
+		return initCalendar(config.SecretFile)
+	case "caldav":
+		return initCalDAV(config.CalDAVServer, config.CalDAVUsername, config.CalDAVPassword)
+	case "ics":
+		return initICSFile()
+	}
+	return nil, fmt.Errorf("unknown calendar backend %q", config.CalendarBackend)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+// init() parses the command line, which under "go test" is full of -test
+// flags it doesn't know; hide them until TestMain (package variables are
+// set before any init runs).
+var testArgs = func() []string {
+	args := os.Args
+	os.Args = args[:1]
+	return args
+}()
+
+var testConfig Config
+
+func TestMain(m *testing.M) {
+	os.Args = testArgs
+	flag.Parse()
+	testConfig = baseConfig
+	os.Exit(m.Run())
+}
+
+// fakeBackend is an in-memory CalendarBackend. It counts the calls it
+// gets, and fails any call on a calendar listed in fail.
+type fakeBackend struct {
+	calendars map[string][]*calendarEvent
+	fail      map[string]error
+	nextID    int
+	lists     int
+	writes    int
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		calendars: make(map[string][]*calendarEvent),
+		fail:      make(map[string]error),
+	}
+}
+
+func (f *fakeBackend) ListEvents(calendarID string, start time.Time, end time.Time) ([]*calendarEvent, error) {
+	f.lists++
+	if err := f.fail[calendarID]; err != nil {
+		return nil, err
+	}
+	result := []*calendarEvent{}
+	for _, e := range f.calendars[calendarID] {
+		if e.overlaps(start, end) || (e.Start.Equal(e.End) && !e.Start.Before(start) && e.Start.Before(end)) {
+			result = append(result, copyEvent(e))
+		}
+	}
+	return result, nil
+}
+
+func (f *fakeBackend) InsertEvent(calendarID string, event *calendarEvent) error {
+	f.writes++
+	if err := f.fail[calendarID]; err != nil {
+		return err
+	}
+	if event.ID == "" {
+		f.nextID++
+		event.ID = fmt.Sprintf("fake-%d", f.nextID)
+	}
+	f.calendars[calendarID] = append(f.calendars[calendarID], copyEvent(event))
+	return nil
+}
+
+func (f *fakeBackend) UpdateEvent(calendarID string, event *calendarEvent) error {
+	f.writes++
+	if err := f.fail[calendarID]; err != nil {
+		return err
+	}
+	for i, e := range f.calendars[calendarID] {
+		if e.ID == event.ID {
+			f.calendars[calendarID][i] = copyEvent(event)
+			return nil
+		}
+	}
+	return fmt.Errorf("no event %q in %s", event.ID, calendarID)
+}
+
+func (f *fakeBackend) DeleteEvent(calendarID string, eventID string) error {
+	f.writes++
+	if err := f.fail[calendarID]; err != nil {
+		return err
+	}
+	events := f.calendars[calendarID]
+	for i, e := range events {
+		if e.ID == eventID {
+			f.calendars[calendarID] = append(events[:i:i], events[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no event %q in %s", eventID, calendarID)
+}
+
+// add puts an event in a calendar directly, without counting as a write.
+func (f *fakeBackend) add(calendarID string, e *calendarEvent) *calendarEvent {
+	f.nextID++
+	if e.ID == "" {
+		e.ID = fmt.Sprintf("fake-%d", f.nextID)
+	}
+	f.calendars[calendarID] = append(f.calendars[calendarID], e)
+	return e
+}
+
+// summaries lists a calendar's events as "YYYY-MM-DD summary", sorted.
+func (f *fakeBackend) summaries(calendarID string) []string {
+	var result []string
+	for _, e := range f.calendars[calendarID] {
+		result = append(result, eventDay(e)+" "+e.Summary)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// allDayEvent is an all-day event from first up to (not including) end,
+// dates as YYYY-MM-DD, read in the rota's time zone as the backends do.
+func allDayEvent(summary string, first string, end string) *calendarEvent {
+	start, _ := parseDate(first)
+	stop, _ := parseDate(end)
+	return &calendarEvent{Summary: summary, Start: start, End: stop, AllDay: true}
+}
+
+// setupTest starts a test off with the example config, minus anything that
+// talks to the outside world, and calendars "oncall" and "away" in a fresh
+// fakeBackend. tz is the rota's time zone ("" for the default).
+func setupTest(t *testing.T, tz string) *fakeBackend {
+	saved := baseConfig
+	t.Cleanup(func() {
+		baseConfig = saved
+		config = saved
+		useRotation(rotationConfig{})
+		failures = nil
+	})
+
+	c := testConfig
+	c.CalendarBackend = "fake"
+	c.OncallCalendar = "oncall"
+	c.AvailabilityCalendar = "away"
+	c.TimeZone = tz
+	c.OpsGenie = ogConfig{}
+	c.SlackEmergency = false
+	c.SlackChannel = ""
+	c.MailServer = ""
+	c.AuditLog = ""
+	c.StateFile = ""
+	c.JournalDir = ""
+	c.SyncCache = ""
+	c.Oncallers = append([]oncallPerson{}, testConfig.Oncallers...)
+	for i := range c.Oncallers {
+		c.Oncallers[i].Email = ""
+	}
+	baseConfig = c
+	useRotation(rotationConfig{})
+	failures = nil
+	return newFakeBackend()
+}
+
+func TestFakeBackendRoundTrip(t *testing.T) {
+	f := setupTest(t, "Europe/Vienna")
+	day, _ := parseDate("2026-03-10")
+	cal := newCacheBackend(f)
+
+	if err := prefetchDays(cal, day, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := setOncallByDay(cal, day, oncallersByCode["bob"], false); err != nil {
+		t.Fatal(err)
+	}
+	if err := setOncallByDay(cal, day, oncallersByCode["fb"], true); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.summaries("oncall"); len(got) != 1 || got[0] != "2026-03-10 fb onduty-fix" {
+		t.Errorf("oncall calendar: %q", got)
+	}
+
+	// A fresh look at the calendar finds the same.
+	useRotation(rotationConfig{})
+	d, err := getOncallByDay(f, day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Victim.Code != "fb" || !d.Fixed {
+		t.Errorf("got %+v", d)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// rotateBackup picks the secondary oncaller for a day once the primary
+// rota is settled. Ideally that's whoever is primary the day after, so
+// the backup is already warmed up for their own shift; otherwise it's the
+// next available person after the primary. Backup days don't count
+// towards anyone's monthly limits.
+func rotateBackup(cal CalendarBackend, day time.Time) error {
+	today := oncall.Days[dateFormat(day)]
+	if today.BackupFixed {
+		if *flagVerbose {
+			fmt.Printf("%s: %s # Backup,Fixed\n", day.Format("Mon 2006-01-02"), today.Backup.Code)
+		}
+		return nil
+	}
+
+	away, err := getAwayList(cal, day)
+	if err != nil {
+		return failDay(day, "calendar", err)
+	}
+	backup := findBackup(day, today.Victim, away)
+	if *flagVerbose {
+		fmt.Printf("%s: %s # Backup for %s\n", day.Format("Mon 2006-01-02"), backup.Code, today.Victim.Code)
+	}
+	reason := overrideReason(cal, day, today.Backup, backup)
+	if err := setBackupByDay(cal, day, backup); err != nil {
+		return failDay(day, "calendar", err)
+	}
+	if config.OpsGenie.APIKey != "" {
+		if err := setOpsgenieBackupByDay(day, backup.Email, reason); err != nil {
+			return failDay(day, "opsgenie", err)
+		}
+	}
+	return nil
+}
+
+func findBackup(day time.Time, primary oncallPerson, away []string) oncallPerson {
+	if tomorrow, ok := oncall.Days[dateFormat(day.AddDate(0, 0, 1))]; ok {
+		next := tomorrow.Victim
+		if next.Code != "" && next.Code != primary.Code &&
+			next.Code != oncallerShadow.Code && !isListed(next.Code, away) {
+			return next
+		}
+	}
+	// never the same person twice
+	return findNextOncall(append(away, primary.Code), primary, true)
+}
+
+func setBackupByDay(cal CalendarBackend, day time.Time, victim oncallPerson) error {
+	existing := oncall.Days[dateFormat(day)]
+	if existing.Backup.Code == victim.Code {
+		return nil
+	}
+	reason := changeReason(cal, day, existing.Backup, false)
+	_, err := writeRoleEvent(cal, day, "backup", victim, existing.Backup, false)
+	if err != nil {
+		writeAudit(auditEntry{Target: "calendar", Role: "backup", Day: dateFormat(day),
+			Old: existing.Backup.Code, New: victim.Code, Reason: reason, Failed: true})
+		return err
+	}
+	auditOncall(day, "backup", existing.Backup, victim, reason)
+	recordBackup(day, victim)
+	existing.Backup = victim
+	existing.BackupFixed = false
+	return nil
+}
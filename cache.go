@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Rather than asking the calendar about every day separately, rotator
+// loads the whole range it's going to work on with one query per
+// calendar (see prefetchDays), and answers the per-day queries from that.
+// Events are filed under every (UTC) day they cover, so a two-week all-day
+// event turns up on each of its days. Writes go straight through, and
+// update the cached copy too. Queries outside anything loaded go to the
+// calendar as before.
+type cacheBackend struct {
+	cal       CalendarBackend
+	calendars map[string]*cachedCalendar
+}
+
+type cachedCalendar struct {
+	ranges [][2]time.Time
+	days   map[string][]*calendarEvent
+	keys   map[*calendarEvent][]string
+	byID   map[string]*calendarEvent
+}
+
+// rangeLoader is implemented by backends that can load a range of a
+// calendar up front (and by the wrappers around them).
+type rangeLoader interface {
+	LoadRange(calendarID string, start time.Time, end time.Time) error
+}
+
+// loadRange has cal load [start, end) of a calendar, if it can.
+func loadRange(cal CalendarBackend, calendarID string, start time.Time, end time.Time) error {
+	if l, ok := cal.(rangeLoader); ok {
+		return l.LoadRange(calendarID, start, end)
+	}
+	return nil
+}
+
+func newCacheBackend(cal CalendarBackend) *cacheBackend {
+	return &cacheBackend{cal: cal, calendars: make(map[string]*cachedCalendar)}
+}
+
+func newCachedCalendar() *cachedCalendar {
+	return &cachedCalendar{
+		days: make(map[string][]*calendarEvent),
+		keys: make(map[*calendarEvent][]string),
+		byID: make(map[string]*calendarEvent),
+	}
+}
+
+func (c *cacheBackend) LoadRange(calendarID string, start time.Time, end time.Time) error {
+	cc, ok := c.calendars[calendarID]
+	if ok && cc.covers(start, end) {
+		return nil
+	}
+	// Calendars that can be synced incrementally are, the first time
+	// they're needed (see sync.go).
+	if s, canSync := c.cal.(eventSyncer); canSync && !ok && config.SyncCache != "" {
+		if err := c.syncCalendar(s, calendarID, start); err != nil {
+			return err
+		}
+		cc = c.calendars[calendarID]
+		if cc.covers(start, end) {
+			return nil
+		}
+	}
+	events, err := c.cal.ListEvents(calendarID, start, end)
+	if err != nil {
+		return err
+	}
+	if cc == nil {
+		cc = newCachedCalendar()
+		c.calendars[calendarID] = cc
+	}
+	cc.ranges = append(cc.ranges, [2]time.Time{start, end})
+	for _, e := range events {
+		cc.add(copyEvent(e))
+	}
+	if *flagDebug {
+		fmt.Printf("Loaded %d events from %s to %s\n", len(events), dateFormat(start), dateFormat(end))
+	}
+	return nil
+}
+
+func (c *cacheBackend) ListEvents(calendarID string, start time.Time, end time.Time) ([]*calendarEvent, error) {
+	cc, ok := c.calendars[calendarID]
+	if !ok || !cc.covers(start, end) {
+		return c.cal.ListEvents(calendarID, start, end)
+	}
+	seen := make(map[*calendarEvent]bool)
+	result := []*calendarEvent{}
+	for day := utcDay(start); day.Before(end); day = day.AddDate(0, 0, 1) {
+		for _, e := range cc.days[dateFormat(day)] {
+			if !seen[e] && inRange(e, start, end) {
+				seen[e] = true
+				result = append(result, copyEvent(e))
+			}
+		}
+	}
+	return result, nil
+}
+
+func (c *cacheBackend) InsertEvent(calendarID string, event *calendarEvent) error {
+	if err := c.cal.InsertEvent(calendarID, event); err != nil {
+		return err
+	}
+	if cc, ok := c.calendars[calendarID]; ok {
+		cc.add(copyEvent(event))
+	}
+	return nil
+}
+
+func (c *cacheBackend) UpdateEvent(calendarID string, event *calendarEvent) error {
+	if err := c.cal.UpdateEvent(calendarID, event); err != nil {
+		return err
+	}
+	if cc, ok := c.calendars[calendarID]; ok {
+		cc.add(copyEvent(event))
+	}
+	return nil
+}
+
+func (c *cacheBackend) DeleteEvent(calendarID string, eventID string) error {
+	if err := c.cal.DeleteEvent(calendarID, eventID); err != nil {
+		return err
+	}
+	if cc, ok := c.calendars[calendarID]; ok {
+		if e, ok := cc.byID[eventID]; ok {
+			cc.remove(e)
+		}
+	}
+	return nil
+}
+
+// covers reports whether [start, end) lies within a loaded range.
+func (cc *cachedCalendar) covers(start time.Time, end time.Time) bool {
+	for _, r := range cc.ranges {
+		if !start.Before(r[0]) && !end.After(r[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// add files e under each day it covers (within the loaded ranges),
+// replacing any earlier version of it.
+func (cc *cachedCalendar) add(e *calendarEvent) {
+	if e.ID != "" {
+		if old, ok := cc.byID[e.ID]; ok {
+			cc.remove(old)
+		}
+		cc.byID[e.ID] = e
+	}
+	var keys []string
+	for _, r := range cc.ranges {
+		start, end := e.Start, e.End
+		if start.Before(r[0]) {
+			start = r[0]
+		}
+		if end.After(r[1]) {
+			end = r[1]
+		}
+		if end.Before(start) {
+			continue
+		}
+		// (events that take no time at all still go under their day)
+		day := utcDay(start)
+		for {
+			key := dateFormat(day)
+			if !isListed(key, keys) {
+				cc.days[key] = append(cc.days[key], e)
+				keys = append(keys, key)
+			}
+			day = day.AddDate(0, 0, 1)
+			if !day.Before(end) {
+				break
+			}
+		}
+	}
+	cc.keys[e] = keys
+}
+
+func (cc *cachedCalendar) remove(e *calendarEvent) {
+	for _, key := range cc.keys[e] {
+		events := cc.days[key]
+		for i, other := range events {
+			if other == e {
+				cc.days[key] = append(events[:i:i], events[i+1:]...)
+				break
+			}
+		}
+	}
+	delete(cc.keys, e)
+	if cc.byID[e.ID] == e {
+		delete(cc.byID, e.ID)
+	}
+}
+
+// inRange is overlaps, except that events that take no time at all are
+// in range where they start, as calendars return them.
+func inRange(e *calendarEvent, start time.Time, end time.Time) bool {
+	if !e.End.After(e.Start) {
+		return !e.Start.Before(start) && e.Start.Before(end)
+	}
+	return e.overlaps(start, end)
+}
+
+// utcDay is the start of t's day in UTC, which doesn't depend on the time
+// zone of whichever rotation is active.
+func utcDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
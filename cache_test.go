@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Absences around a rota for 2026-11-10 and the ten days after, for which
+// prefetchDays loads 2026-10-30 up to 2026-12-03.
+func awayEvents() []*calendarEvent {
+	spanning := &calendarEvent{Summary: "jd away"}
+	spanning.Start, _ = time.ParseInLocation("2006-01-02 15:04", "2026-11-16 18:00", rotaLocation)
+	spanning.End, _ = time.ParseInLocation("2006-01-02 15:04", "2026-11-18 09:00", rotaLocation)
+	return []*calendarEvent{
+		// begins before what's loaded
+		allDayEvent("aa urlaub", "2026-10-20", "2026-11-05"),
+		// ends after it
+		allDayEvent("bob urlaub", "2026-11-28", "2026-12-20"),
+		// no end to speak of: just the one day
+		allDayEvent("fb krank", "2026-11-12", "2026-11-12"),
+		// over two midnights, so takes up the whole day in between
+		spanning,
+	}
+}
+
+func TestCacheAwayEvents(t *testing.T) {
+	want := map[string]string{
+		"2026-10-30": "aa", "2026-11-04": "aa", "2026-11-05": "",
+		"2026-11-11": "", "2026-11-12": "fb", "2026-11-13": "",
+		"2026-11-16": "", "2026-11-17": "jd", "2026-11-18": "",
+		"2026-11-27": "", "2026-11-28": "bob", "2026-12-02": "bob",
+	}
+
+	for _, tz := range []string{"Pacific/Auckland", "America/Los_Angeles"} {
+		f := setupTest(t, tz)
+		for _, e := range awayEvents() {
+			f.add("away", e)
+		}
+		cal := newCacheBackend(f)
+		first, _ := parseDate("2026-11-10")
+		if err := prefetchDays(cal, first, 10); err != nil {
+			t.Fatal(err)
+		}
+
+		lists := f.lists
+		cached := make(map[string]string)
+		day, _ := parseDate("2026-10-30")
+		for ; dateFormat(day) < "2026-12-03"; day = day.AddDate(0, 0, 1) {
+			away, err := getAwayList(cal, day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cached[dateFormat(day)] = joinSorted(away)
+		}
+		if f.lists != lists {
+			t.Errorf("%s: %d queries went past the cache", tz, f.lists-lists)
+		}
+
+		for date, got := range cached {
+			if w, ok := want[date]; ok && got != w {
+				t.Errorf("%s %s: away %q, want %q", tz, date, got, w)
+			}
+			// the calendar itself says the same
+			day, _ := parseDate(date)
+			away, err := getAwayList(f, day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if direct := joinSorted(away); got != direct {
+				t.Errorf("%s %s: cache says %q, calendar %q", tz, date, got, direct)
+			}
+		}
+	}
+}
+
+func joinSorted(codes []string) string {
+	codes = append([]string{}, codes...)
+	sort.Strings(codes)
+	return strings.Join(codes, ",")
+}
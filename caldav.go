@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The server expands recurring events into their instances for us, each
+// with a RECURRENCE-ID, so that a weekly "aa away" blocks every week.
+var caldavQuery = string(`<?xml version="1.0" encoding="utf-8" ?>
+<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop>
+    <D:getetag/>
+    <C:calendar-data>
+      <C:expand start="%[1]s" end="%[2]s"/>
+    </C:calendar-data>
+  </D:prop>
+  <C:filter>
+    <C:comp-filter name="VCALENDAR">
+      <C:comp-filter name="VEVENT">
+        <C:time-range start="%[1]s" end="%[2]s"/>
+      </C:comp-filter>
+    </C:comp-filter>
+  </C:filter>
+</C:calendar-query>`)
+
+// caldavBackend talks to a CalDAV server (Nextcloud, Radicale, ...).
+// Calendar IDs are collection paths (or full URLs) resolved against
+// CalDAVServer, and event IDs are the hrefs of the calendar resources,
+// plus "#" and the instance (see recurrenceKey) for instances of
+// recurring events.
+type caldavBackend struct {
+	server   *url.URL
+	username string
+	password string
+	client   *http.Client
+}
+
+type davMultistatus struct {
+	Responses []davResponse `xml:"DAV: response"`
+}
+
+type davResponse struct {
+	Href     string        `xml:"DAV: href"`
+	Propstat []davPropstat `xml:"DAV: propstat"`
+}
+
+type davPropstat struct {
+	Status string `xml:"DAV: status"`
+	Prop   struct {
+		ETag         string `xml:"DAV: getetag"`
+		CalendarData string `xml:"urn:ietf:params:xml:ns:caldav calendar-data"`
+	} `xml:"DAV: prop"`
+}
+
+func initCalDAV(server string, username string, password string) (*caldavBackend, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("CalDAV server %q should be a full URL", server)
+	}
+	return &caldavBackend{
+		server:   u,
+		username: username,
+		password: password,
+		client:   &http.Client{Timeout: 60 * time.Second, Transport: newRetryTransport(nil)},
+	}, nil
+}
+
+// resolve turns a calendar ID or href into an absolute URL.
+func (c *caldavBackend) resolve(ref string) (*url.URL, error) {
+	r, err := url.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	return c.server.ResolveReference(r), nil
+}
+
+func (c *caldavBackend) collection(calendarID string) (*url.URL, error) {
+	if !strings.HasSuffix(calendarID, "/") {
+		calendarID += "/"
+	}
+	return c.resolve(calendarID)
+}
+
+func (c *caldavBackend) do(method string, u *url.URL, body []byte, headers map[string]string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return resp, data, fmt.Errorf("CalDAV %s %s failed: %s", method, u.Path, resp.Status)
+	}
+	return resp, data, nil
+}
+
+func (c *caldavBackend) ListEvents(calendarID string, start time.Time, end time.Time) ([]*calendarEvent, error) {
+	u, err := c.collection(calendarID)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf(caldavQuery,
+		start.UTC().Format(icsUTCTimeString),
+		end.UTC().Format(icsUTCTimeString))
+	_, data, err := c.do("REPORT", u, []byte(query), map[string]string{
+		"Depth":        "1",
+		"Content-Type": "application/xml; charset=utf-8",
+	})
+	if err != nil {
+		return nil, err
+	}
+	var ms davMultistatus
+	if err := xml.Unmarshal(data, &ms); err != nil {
+		return nil, fmt.Errorf("couldn't parse CalDAV response: %s", err)
+	}
+
+	result := []*calendarEvent{}
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstat {
+			if ps.Prop.CalendarData == "" {
+				continue
+			}
+			ics, err := parseICS([]byte(ps.Prop.CalendarData))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", r.Href, err)
+			}
+			for _, e := range ics.events {
+				if !e.event.overlaps(start, end) {
+					continue
+				}
+				e.event.ID = r.Href
+				if e.Recurrence != "" {
+					e.event.ID += "#" + e.Recurrence
+				}
+				result = append(result, e.event)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (c *caldavBackend) InsertEvent(calendarID string, event *calendarEvent) error {
+	if *flagDryRun {
+		return nil
+	}
+	u, err := c.collection(calendarID)
+	if err != nil {
+		return err
+	}
+	uid := newUID()
+	u, err = u.Parse(strings.TrimSuffix(uid, "@rotator") + ".ics")
+	if err != nil {
+		return err
+	}
+	ics := &icsCalendar{events: []*icsEvent{{UID: uid, event: event}}}
+	_, _, err = c.do("PUT", u, ics.encode(), map[string]string{
+		"Content-Type":  "text/calendar; charset=utf-8",
+		"If-None-Match": "*",
+	})
+	if err != nil {
+		return err
+	}
+	event.ID = u.Path
+	return nil
+}
+
+// UpdateEvent re-reads the resource so that anything we don't manage
+// survives, and uses its ETag to avoid clobbering concurrent edits. Only
+// the VEVENT for the event (or instance) in question changes; changing an
+// instance that has no VEVENT of its own yet adds one.
+func (c *caldavBackend) UpdateEvent(calendarID string, event *calendarEvent) error {
+	if *flagDryRun {
+		return nil
+	}
+	return c.modify(event.ID, func(ics *icsCalendar, instance string) error {
+		target := ics.instance(instance)
+		if target == nil {
+			master := ics.instance("")
+			if instance == "" || master == nil {
+				return fmt.Errorf("%s: no such VEVENT in resource", event.ID)
+			}
+			target = &icsEvent{UID: master.UID, Recurrence: instance,
+				extra: []string{recurrenceLine("RECURRENCE-ID", instance)}}
+			ics.events = append(ics.events, target)
+		}
+		target.event = event
+		return nil
+	})
+}
+
+// DeleteEvent removes the resource, or for an instance of a recurring
+// event, excludes that instance from it.
+func (c *caldavBackend) DeleteEvent(calendarID string, eventID string) error {
+	if *flagDryRun {
+		return nil
+	}
+	href, instance := splitCalDAVID(eventID)
+	if instance == "" {
+		u, err := c.resolve(href)
+		if err != nil {
+			return err
+		}
+		_, _, err = c.do("DELETE", u, nil, nil)
+		return err
+	}
+	return c.modify(eventID, func(ics *icsCalendar, instance string) error {
+		master := ics.instance("")
+		if master == nil {
+			return fmt.Errorf("%s: no recurring VEVENT in resource", eventID)
+		}
+		for i, e := range ics.events {
+			if e.Recurrence == instance {
+				ics.events = append(ics.events[:i], ics.events[i+1:]...)
+				break
+			}
+		}
+		master.extra = append(master.extra, recurrenceLine("EXDATE", instance))
+		return nil
+	})
+}
+
+// modify reads the resource holding an event, has change make its
+// changes, and writes it back if nobody else changed it meanwhile.
+func (c *caldavBackend) modify(eventID string, change func(ics *icsCalendar, instance string) error) error {
+	href, instance := splitCalDAVID(eventID)
+	u, err := c.resolve(href)
+	if err != nil {
+		return err
+	}
+	resp, data, err := c.do("GET", u, nil, nil)
+	if err != nil {
+		return err
+	}
+	ics, err := parseICS(data)
+	if err != nil {
+		return fmt.Errorf("%s: %s", href, err)
+	}
+	if len(ics.events) == 0 {
+		return fmt.Errorf("%s: no VEVENT in resource", href)
+	}
+	if err := change(ics, instance); err != nil {
+		return err
+	}
+
+	headers := map[string]string{"Content-Type": "text/calendar; charset=utf-8"}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		headers["If-Match"] = etag
+	}
+	_, _, err = c.do("PUT", u, ics.encode(), headers)
+	return err
+}
+
+func splitCalDAVID(eventID string) (string, string) {
+	if i := strings.LastIndex(eventID, "#"); i >= 0 {
+		return eventID[:i], eventID[i+1:]
+	}
+	return eventID, ""
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A weekly absence with its second week moved to the Wednesday, as stored
+// and as the server expands it for 2026-03-02 to 2026-03-23.
+const caldavWeekly = "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n" +
+	"BEGIN:VEVENT\r\nUID:weekly\r\nSUMMARY:aa away\r\nDTSTART;VALUE=DATE:20260302\r\nDTEND;VALUE=DATE:20260303\r\n" +
+	"RRULE:FREQ=WEEKLY\r\nATTENDEE;CN=Alice;PARTSTAT=ACCEPTED:mailto:aa@example.com\r\nEND:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\nUID:weekly\r\nRECURRENCE-ID;VALUE=DATE:20260309\r\nSUMMARY:aa away\r\nDTSTART;VALUE=DATE:20260311\r\nDTEND;VALUE=DATE:20260312\r\n" +
+	"ATTENDEE;CN=Alice;PARTSTAT=ACCEPTED:mailto:aa@example.com\r\nEND:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+const caldavExpanded = "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n" +
+	"BEGIN:VEVENT\r\nUID:weekly\r\nRECURRENCE-ID;VALUE=DATE:20260302\r\nSUMMARY:aa away\r\nDTSTART;VALUE=DATE:20260302\r\nDTEND;VALUE=DATE:20260303\r\nEND:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\nUID:weekly\r\nRECURRENCE-ID;VALUE=DATE:20260309\r\nSUMMARY:aa away\r\nDTSTART;VALUE=DATE:20260311\r\nDTEND;VALUE=DATE:20260312\r\nEND:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\nUID:weekly\r\nRECURRENCE-ID;VALUE=DATE:20260316\r\nSUMMARY:aa away\r\nDTSTART;VALUE=DATE:20260316\r\nDTEND;VALUE=DATE:20260317\r\nEND:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+// fakeCalDAV serves one resource, /cal/weekly.ics.
+type fakeCalDAV struct {
+	t        *testing.T
+	resource string
+	etag     string
+}
+
+func (f *fakeCalDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	switch r.Method {
+	case "REPORT":
+		if !strings.Contains(string(body), `<C:expand start="20260302T000000Z" end="20260323T000000Z"/>`) {
+			f.t.Errorf("query doesn't ask for expansion:\n%s", body)
+		}
+		w.WriteHeader(207)
+		w.Write([]byte(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:" xmlns:cal="urn:ietf:params:xml:ns:caldav">` +
+			`<d:response><d:href>/cal/weekly.ics</d:href><d:propstat><d:prop><d:getetag>` + f.etag + `</d:getetag>` +
+			`<cal:calendar-data>` + caldavExpanded + `</cal:calendar-data></d:prop>` +
+			`<d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response></d:multistatus>`))
+	case "GET":
+		w.Header().Set("ETag", f.etag)
+		w.Write([]byte(f.resource))
+	case "PUT":
+		if r.Header.Get("If-Match") != f.etag {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		f.resource = string(body)
+		f.etag += "1"
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestCalDAVRecurring(t *testing.T) {
+	setupTest(t, "Europe/Vienna")
+	f := &fakeCalDAV{t: t, resource: caldavWeekly, etag: `"1"`}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	c, err := initCalDAV(srv.URL+"/", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	events, err := c.ListEvents("cal", start, start.AddDate(0, 0, 21))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, e := range events {
+		ids = append(ids, e.ID)
+	}
+	want := "/cal/weekly.ics#20260302 /cal/weekly.ics#20260309 /cal/weekly.ics#20260316"
+	if strings.Join(ids, " ") != want {
+		t.Fatalf("got instances %q", ids)
+	}
+
+	// Changing the moved instance changes only its VEVENT.
+	moved := events[1]
+	moved.Summary = "aa krank"
+	moved.Attendees = []string{"aa@example.com"}
+	if err := c.UpdateEvent("cal", moved); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(f.resource, "RRULE:FREQ=WEEKLY") || strings.Count(f.resource, "BEGIN:VEVENT") != 2 {
+		t.Errorf("series damaged:\n%s", f.resource)
+	}
+	if !strings.Contains(f.resource, "SUMMARY:aa krank") || !strings.Contains(f.resource, "SUMMARY:aa away") {
+		t.Errorf("wrong VEVENT changed:\n%s", f.resource)
+	}
+	if strings.Count(f.resource, "ATTENDEE;CN=Alice;PARTSTAT=ACCEPTED:mailto:aa@example.com") != 2 {
+		t.Errorf("attendee parameters lost:\n%s", f.resource)
+	}
+
+	// Changing an instance without a VEVENT of its own adds one.
+	third := events[2]
+	third.Summary = "aa urlaub"
+	if err := c.UpdateEvent("cal", third); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(f.resource, "RECURRENCE-ID;VALUE=DATE:20260316\r\n") ||
+		strings.Count(f.resource, "BEGIN:VEVENT") != 3 {
+		t.Errorf("no override added:\n%s", f.resource)
+	}
+
+	// Deleting an instance excludes it from the series.
+	if err := c.DeleteEvent("cal", moved.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(f.resource, "EXDATE;VALUE=DATE:20260309\r\n") || strings.Contains(f.resource, "aa krank") {
+		t.Errorf("instance not deleted:\n%s", f.resource)
+	}
+	if strings.Count(f.resource, "BEGIN:VEVENT") != 2 {
+		t.Errorf("wrong number of VEVENTs left:\n%s", f.resource)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -27,39 +26,60 @@ func dateFormat(day time.Time) string {
 
 // getClient uses a Context and Config to retrieve a Token
 // then generate a Client. It returns the generated Client.
-func getClient(ctx context.Context, config *oauth2.Config) *http.Client {
+func getClient(ctx context.Context, config *oauth2.Config) (*http.Client, error) {
 	cacheFile, err := tokenCacheFile()
 	if err != nil {
-		log.Fatalf("Unable to get path to cached credential file. %v", err)
+		return nil, fmt.Errorf("unable to get path to cached credential file: %v", err)
 	}
 	tok, err := tokenFromFile(cacheFile)
 	if err != nil {
-		tok = getTokenFromWeb(config)
-		saveToken(cacheFile, tok)
+		tok, err = getTokenFromWeb(config)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Saving credential file to: %s\n", cacheFile)
+		if err := saveToken(cacheFile, tok); err != nil {
+			return nil, err
+		}
 	}
-	return config.Client(ctx, tok)
+	ts := &savingTokenSource{base: config.TokenSource(ctx, tok), file: cacheFile, last: tok.AccessToken}
+	return oauth2.NewClient(ctx, ts), nil
 }
 
-func getDayEvents(srv *calendar.Service, day time.Time) ([]*calendar.Event, error) {
-	starttime := day.Truncate(time.Hour * 24).Add(time.Second)
-	endtime := starttime.Add(time.Minute)
-	// calendars, err := srv.Calendars.List
-	events, err := srv.Events.List(config.AvailabilityCalendar).
-		SingleEvents(true).
-		TimeMax(endtime.Format(time.RFC3339)).
-		TimeMin(starttime.Format(time.RFC3339)).
-		OrderBy("startTime").Do()
-	return events.Items, err
+// getDayEvents returns the availability calendar's events that touch day
+// (in the rota's time zone) at all; see coversDay for which of them
+// actually take up the day.
+func getDayEvents(cal CalendarBackend, day time.Time) ([]*calendarEvent, error) {
+	return cal.ListEvents(config.AvailabilityCalendar, dayStart(day), dayStart(day.AddDate(0, 0, 1)))
+}
+
+// coversDay reports whether e takes up the whole of day. All-day events
+// go by their dates (End being the day after the last), so a two-week
+// holiday covers each of its days whatever time zone its calendar is in.
+// Timed events have to last from (at least) midnight to midnight.
+func (e *calendarEvent) coversDay(day time.Time) bool {
+	if e.AllDay {
+		first := dateFormat(e.Start)
+		end := dateFormat(e.End)
+		if !e.End.After(e.Start) {
+			// no (sensible) end: just the one day
+			end = dateFormat(e.Start.AddDate(0, 0, 1))
+		}
+		return first <= dateFormat(day) && dateFormat(day) < end
+	}
+	return !e.Start.After(dayStart(day)) && !e.End.Before(dayStart(day.AddDate(0, 0, 1)))
 }
 
 func getMonthRange(dayOne time.Time, dayCount int) (time.Time, int) {
-	firstDay := time.Date(dayOne.Year(), dayOne.Month(), 1, 0, 0, 0, 0, time.UTC)
+	firstDay := time.Date(dayOne.Year(), dayOne.Month(), 1, 0, 0, 0, 0, rotaLocation)
 	lastDay := dayOne.AddDate(0, 0, dayCount)
+	// count in UTC, where every day is 24 hours long
+	first := time.Date(dayOne.Year(), dayOne.Month(), 1, 0, 0, 0, 0, time.UTC)
 	lastMonthDay := time.Date(lastDay.Year(), lastDay.Month()+1, 0, 0, 0, 0, 0, time.UTC)
-	return firstDay, int(lastMonthDay.Sub(firstDay) / (time.Hour * 24))
+	return firstDay, int(lastMonthDay.Sub(first) / (time.Hour * 24))
 }
 
-func getOncallMonthRestrictions(srv *calendar.Service, month time.Time) map[string]*restriction {
+func getOncallMonthRestrictions(cal CalendarBackend, month time.Time) map[string]*restriction {
 	res := make(map[string]*restriction)
 	res[oncallerShadow.Code] = &restriction{-31, -31}
 
@@ -72,23 +92,22 @@ func getOncallMonthRestrictions(srv *calendar.Service, month time.Time) map[stri
 		return res
 	}
 
-	// FIXME horrible time zone handling here - needs a general solution
-	firstday := time.Date(month.Year(), month.Month(), 1, 3, 0, 0, 0, time.UTC)
+	firstday := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, rotaLocation)
 	// why does this work? because day 0 of a month is the last day of month-1!
-	daysinmonth := time.Date(month.Year(), month.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	daysinmonth := time.Date(month.Year(), month.Month()+1, 0, 0, 0, 0, 0, rotaLocation).Day()
 	for day := 0; day < daysinmonth; day++ {
 		nextday := firstday.AddDate(0, 0, day)
-		oncall := oncall.Days[dateFormat(nextday)]
-		if oncall.Victim.Code == "" {
+		victim := pastOncall(nextday)
+		if victim.Code == "" {
 			continue
 		}
 
-		res[oncall.Victim.Code].DaysBooked++
+		res[victim.Code].DaysBooked++
 		if isWeekend(nextday) {
-			res[oncall.Victim.Code].WeekendsBooked++
+			res[victim.Code].WeekendsBooked++
 			// if day 1 is a Sunday, add 2 to avoid off-by-one errors later on...
 			if nextday.Weekday() == 0 && nextday.Day() == 1 {
-				res[oncall.Victim.Code].WeekendsBooked++
+				res[victim.Code].WeekendsBooked++
 			}
 		}
 		// if *Verbose {
@@ -104,59 +123,58 @@ func getOncallMonthRestrictions(srv *calendar.Service, month time.Time) map[stri
 	return res
 }
 
-// Find the person in the oncall calendar for a given day.
-func getOncallByDay(srv *calendar.Service, day time.Time) *oncallDay {
+// Find the person in the oncall calendar for a given day (and their
+// backup, if there is one). In a follow-the-sun rotation that's the
+// active region's shift on that day.
+func getOncallByDay(cal CalendarBackend, day time.Time) (*oncallDay, error) {
 
-	oncallRe := regexp.MustCompile(`(?i)(\w{2,3}).*onduty(-fix)?`)
-	fixed := false
-	starttime := day.Truncate(time.Hour * 24).Add(time.Second)
+	oncallRe := regexp.MustCompile(`(?i)(\w{2,3}).*onduty(-fix)?` + regionPattern())
+	backupRe := regexp.MustCompile(`(?i)(\w{2,3}).*backup(-fix)?` + regionPattern())
+	result := &oncallDay{}
+	windowStart, _, allDay := roleWindow(day)
+	starttime := windowStart.Add(time.Second)
 	endtime := starttime.Add(time.Minute)
-	// calendars, err := srv.Calendars.List
-	events, err := srv.Events.List(config.OncallCalendar).
-		SingleEvents(true).
-		TimeMax(endtime.Format(time.RFC3339)).
-		TimeMin(starttime.Format(time.RFC3339)).
-		OrderBy("startTime").Do()
+	events, err := cal.ListEvents(config.OncallCalendar, starttime, endtime)
 	if err != nil {
-		log.Fatalf("Couldn't get entries from oncall calendar: %s\n", err)
+		return nil, fmt.Errorf("couldn't get entries from oncall calendar: %s", err)
 	}
-	if len(events.Items) > 0 {
-		for _, event := range events.Items {
-			if event.Start.DateTime == "" {
+	if len(events) > 0 {
+		for _, event := range events {
+			if event.AllDay == allDay {
 				title := event.Summary
-				match := oncallRe.FindStringSubmatch(title)
-				if match == nil {
-					continue
-				} else {
-					if match[2] != "" {
-						fixed = true
+				if match := oncallRe.FindStringSubmatch(title); match != nil {
+					if result.Victim.Code != "" {
+						continue
+					}
+					result.Victim = oncallersByCode[strings.ToLower(match[1])]
+					result.Fixed = match[2] != ""
+				} else if match := backupRe.FindStringSubmatch(title); match != nil {
+					if result.Backup.Code != "" {
+						continue
 					}
-					return &oncallDay{oncallersByCode[strings.ToLower(match[1])], fixed}
+					result.Backup = oncallersByCode[strings.ToLower(match[1])]
+					result.BackupFixed = match[2] != ""
 				}
 			}
 		}
 	}
-	// If nobody was oncall..
-	return &oncallDay{oncallPerson{}, false}
+	// If nobody was oncall, this is all empty.
+	return result, nil
 }
 
 // getTokenFromWeb uses Config to request a Token.
 // It returns the retrieved Token.
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser then type the "+
-		"authorization code: \n%v\n", authURL)
-
-	var code string
-	if _, err := fmt.Scan(&code); err != nil {
-		log.Fatalf("Unable to read authorization code %v", err)
+func getTokenFromWeb(config *oauth2.Config) (*oauth2.Token, error) {
+	code, err := authCodeFromBrowser(config)
+	if err != nil {
+		return nil, err
 	}
 
 	tok, err := config.Exchange(oauth2.NoContext, code)
 	if err != nil {
-		log.Fatalf("Unable to retrieve token from web %v", err)
+		return nil, fmt.Errorf("unable to retrieve token from web: %v", err)
 	}
-	return tok
+	return tok, nil
 }
 
 func isWeekend(day time.Time) bool {
@@ -166,69 +184,107 @@ func isWeekend(day time.Time) bool {
 	return false
 }
 
-func makeAttendees(people []oncallPerson) []*calendar.EventAttendee {
-	var attendees []*calendar.EventAttendee
+func makeAttendees(people []oncallPerson) []string {
+	var attendees []string
 	for _, person := range people {
 		hasmail, _ := regexp.MatchString(`\@`, person.CalendarEmail)
 		if hasmail == true {
-			attendee := calendar.EventAttendee{
-				Email: person.CalendarEmail,
-			}
-			attendees = append(attendees, &attendee)
+			attendees = append(attendees, person.CalendarEmail)
 		}
 	}
 	return attendees
 }
 
-func setOncallByDay(srv *calendar.Service, day time.Time, victim oncallPerson) bool {
+// setOncallByDay makes victim the oncaller for day, unless the day is
+// fixed. With fixed set the day is rewritten regardless and marked fixed
+// ("xx onduty-fix"), so later runs leave it alone.
+func setOncallByDay(cal CalendarBackend, day time.Time, victim oncallPerson, fixed bool) error {
 	// Get existing oncall for day
 
 	existing := oncall.Days[dateFormat(day)]
-	if existing.Victim.Code == victim.Code || existing.Fixed == true {
+	if fixed {
+		if existing.Victim.Code == victim.Code && existing.Fixed {
+			return nil
+		}
+	} else if existing.Victim.Code == victim.Code || existing.Fixed == true {
 		// Nothing to do except increment their load counter if we reset it
 		if *flagUnrestrict == true && existing.Fixed == false {
-			restrictions.Detail[victim.Code].DaysBooked++
-			if isWeekend(day) {
-				restrictions.Detail[victim.Code].WeekendsBooked++
-			}
+			bookDay(victim.Code, day, 1)
 		}
-		return true
+		return nil
 	}
 
 	// otherwise we need to rewrite it.
-	oncallRe := regexp.MustCompile(`(?i)(\w{2,3}).*onduty`)
-	starttime := day.Truncate(time.Hour * 24)
-	endtime := starttime.Add(time.Minute)
+	reason := changeReason(cal, day, existing.Victim, fixed)
+	rewritten, err := writeRoleEvent(cal, day, "onduty", victim, existing.Victim, fixed)
+	if err != nil {
+		writeAudit(auditEntry{Target: "calendar", Role: "onduty", Day: dateFormat(day),
+			Old: existing.Victim.Code, New: victim.Code, Reason: reason, Failed: true})
+		return err
+	}
+	auditOncall(day, "onduty", existing.Victim, victim, reason)
+	recordOncall(day, victim, fixed)
+	// Increment the load counter..
+	bookDay(victim.Code, day, 1)
+	// And decrement it if it was rewritten.
+	if rewritten && existing.Victim.Code != "" {
+		bookDay(existing.Victim.Code, day, -1)
+	}
+	return nil
+}
+
+// bookDay adjusts someone's load counters for the month being worked on.
+// Restrictions are only loaded when there are limits to enforce, and may
+// be for a different month entirely.
+func bookDay(code string, day time.Time, delta int) {
+	if restrictions.Month != day.Month() || restrictions.Year != day.Year() {
+		return
+	}
+	r, ok := restrictions.Detail[code]
+	if !ok {
+		return
+	}
+	r.DaysBooked += delta
+	if isWeekend(day) {
+		r.WeekendsBooked += delta
+	}
+}
+
+// writeRoleEvent rewrites the day's "xx <role>" event to name victim, or
+// creates one if there isn't any; fixed days get "xx <role>-fix". It
+// reports whether an existing event was rewritten.
+func writeRoleEvent(cal CalendarBackend, day time.Time, role string,
+	victim oncallPerson, previous oncallPerson, fixed bool) (bool, error) {
+	title := fmt.Sprintf("%s %s", victim.Code, role)
+	if fixed {
+		title += "-fix"
+	}
+	title += regionTag()
+	roleRe := regexp.MustCompile(`(?i)(\w{2,3}).*` + role + `(-fix)?` + regionPattern())
+	starttime, endtime, allDay := roleWindow(day)
 
-	events, err := srv.Events.List(config.OncallCalendar).
-		SingleEvents(true).
-		TimeMax(endtime.Format(time.RFC3339)).
-		TimeMin(starttime.Format(time.RFC3339)).
-		OrderBy("startTime").Do()
+	events, err := cal.ListEvents(config.OncallCalendar, starttime, starttime.Add(time.Minute))
 	if err != nil {
-		log.Fatalf("Couldn't get entries from oncall calendar: %s\n", err)
+		return false, fmt.Errorf("couldn't get entries from oncall calendar: %s", err)
 	}
 	rewritten := false
-	if len(events.Items) > 0 {
-		for _, event := range events.Items {
-			title := event.Summary
-			match := oncallRe.FindStringSubmatch(title)
+	if len(events) > 0 {
+		for _, event := range events {
+			match := roleRe.FindStringSubmatch(event.Summary)
 			if match == nil {
 				continue
 			} else {
 				eventAttendees := makeAttendees([]oncallPerson{victim})
 				event.Attendees = eventAttendees
-				event.Summary = fmt.Sprintf("%s onduty", victim.Code)
-				if *flagDryRun == false {
-					_, err := srv.Events.Update(config.OncallCalendar, event.Id, event).Do()
-					if err != nil {
-						log.Fatalf("Event update failed: %s\n", err)
-					}
+				event.Summary = title
+				err := cal.UpdateEvent(config.OncallCalendar, event)
+				if err != nil {
+					return rewritten, fmt.Errorf("event update failed: %s", err)
 				}
 				if *flagVerbose {
-					fmt.Printf("%s is now oncall on %s (was %s)\n", victim.Code,
+					fmt.Printf("%s is now %s on %s (was %s)\n", victim.Code, role,
 						day.Format("2006-01-02"),
-						existing.Victim.Code)
+						previous.Code)
 				}
 				rewritten = true
 			}
@@ -236,38 +292,28 @@ func setOncallByDay(srv *calendar.Service, day time.Time, victim oncallPerson) b
 	}
 	if rewritten == false {
 		eventAttendees := makeAttendees([]oncallPerson{victim})
-		newEvent := calendar.Event{
+		newEvent := calendarEvent{
 			Attendees: eventAttendees,
-			Summary:   fmt.Sprintf("%s onduty", victim.Code),
-			Start:     &calendar.EventDateTime{Date: starttime.Format("2006-01-02")},
-			End:       &calendar.EventDateTime{Date: starttime.AddDate(0, 0, 1).Format("2006-01-02")},
-		}
-		if *flagDryRun == false {
-			_, err := srv.Events.Insert(config.OncallCalendar, &newEvent).Do()
-			if err != nil {
-				fmt.Println(err)
-				return false
-			}
+			Summary:   title,
+			Start:     starttime,
+			End:       endtime,
+			AllDay:    allDay,
 		}
-	}
-	// Increment the load counter..
-	restrictions.Detail[victim.Code].DaysBooked++
-	if isWeekend(day) {
-		restrictions.Detail[victim.Code].WeekendsBooked++
-	}
-	// And decrement it if it was rewritten.
-	if rewritten && existing.Victim.Code != "" {
-		restrictions.Detail[existing.Victim.Code].DaysBooked--
-		if isWeekend(day) {
-			restrictions.Detail[existing.Victim.Code].WeekendsBooked--
+		err := cal.InsertEvent(config.OncallCalendar, &newEvent)
+		if err != nil {
+			return false, fmt.Errorf("event insert failed: %s", err)
 		}
 	}
-	return true
+	return rewritten, nil
 }
 
-// tokenCacheFile generates credential file path/filename.
+// tokenCacheFile generates credential file path/filename (TokenFile, or
+// by default ~/.credentials/calendar-go.json).
 // It returns the generated credential path/filename.
 func tokenCacheFile() (string, error) {
+	if config.TokenFile != "" {
+		return config.TokenFile, os.MkdirAll(filepath.Dir(config.TokenFile), 0700)
+	}
 	usr, err := user.Current()
 	if err != nil {
 		return "", err
@@ -293,32 +339,50 @@ func tokenFromFile(file string) (*oauth2.Token, error) {
 
 // saveToken uses a file path to create a file and store the
 // token in it.
-func saveToken(file string, token *oauth2.Token) {
-	fmt.Printf("Saving credential file to: %s\n", file)
-	f, err := os.Create(file)
+func saveToken(file string, token *oauth2.Token) error {
+	data, err := json.Marshal(token)
 	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+		return err
 	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
+	if err := createPrivate(file); err != nil {
+		return fmt.Errorf("unable to cache oauth token: %v", err)
+	}
+	if err := writeFileAtomic(file, append(data, '\n')); err != nil {
+		return fmt.Errorf("unable to cache oauth token: %v", err)
+	}
+	return nil
 }
 
-func initCalendar(secretfile string) (*calendar.Service, error) {
-	ctx := context.Background()
+func initCalendar(secretfile string) (*googleBackend, error) {
+	// The OAuth client sends its requests through this one, so every
+	// calendar call gets retried as need be.
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient,
+		&http.Client{Transport: newRetryTransport(nil)})
 
 	b, err := ioutil.ReadFile(secretfile)
 	if err != nil {
-		log.Fatalf("Unable to read client secret file: %v", err)
+		return nil, fmt.Errorf("unable to read client secret file: %v", err)
 	}
 
-	// If modifying these scopes, delete your previously saved credentials
-	// at ~/.credentials/calendar-go-quickstart.json
-	config, err := google.ConfigFromJSON(b, calendar.CalendarScope)
-	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
+	var client *http.Client
+	if isServiceAccount(b) {
+		client, err = serviceAccountClient(ctx, b, config.ImpersonateUser)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// If modifying these scopes, delete your previously saved credentials
+		// at ~/.credentials/calendar-go-quickstart.json
+		oauthConfig, err := google.ConfigFromJSON(b, calendar.CalendarScope)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse client secret file to config: %v", err)
+		}
+		client, err = getClient(ctx, oauthConfig)
+		if err != nil {
+			return nil, err
+		}
 	}
-	client := getClient(ctx, config)
 
 	srv, err := calendar.New(client)
-	return srv, err
+	return &googleBackend{srv}, err
 }
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+)
+
+// runCommand runs one of the commands that can be given after the flags,
+// instead of generating the rota.
+func runCommand(cal CalendarBackend, args []string) error {
+	var err error
+	switch args[0] {
+	case "swap":
+		err = swapCommand(cal, args[1:])
+	case "override":
+		err = overrideCommand(cal, args[1:])
+	case "history":
+		err = historyCommand(args[1:])
+	case "apply":
+		err = applyCommand(cal, args[1:])
+	case "rollback":
+		err = rollbackCommand(cal, args[1:])
+	default:
+		err = fmt.Errorf("unknown command (try plan, apply, rollback, swap, override, history or watch)")
+	}
+	return err
+}
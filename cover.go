@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Covers are timed "xx cover-fix for yy" events in the oncall calendar,
+// for someone standing in for part of a day. They're never touched by
+// the rota generator, which only looks at whole days.
+var coverRe = regexp.MustCompile(`(?i)(\w{2,3}).*cover`)
+
+// overrideCommand handles "override DATE START END CODE [for CODE]", where
+// DATE may also be "today" or "tomorrow" and START and END are HH:MM in
+// the rota's time zone. A cover that ends before it starts runs past
+// midnight.
+func overrideCommand(cal CalendarBackend, args []string) error {
+	if len(args) != 4 && !(len(args) == 6 && args[4] == "for") {
+		return errors.New("usage: override DATE START END CODE [for CODE]")
+	}
+
+	var day time.Time
+	var err error
+	switch args[0] {
+	case "today":
+		day = rotaNow()
+	case "tomorrow":
+		day = rotaNow().AddDate(0, 0, 1)
+	default:
+		day, err = parseDate(args[0])
+		if err != nil {
+			return fmt.Errorf("bad date %q (want YYYY-MM-DD)", args[0])
+		}
+	}
+	for _, clock := range args[1:3] {
+		if _, err := time.Parse("15:04", clock); err != nil {
+			return fmt.Errorf("bad time %q (want HH:MM)", clock)
+		}
+	}
+	start := atClock(day, args[1])
+	end := atClock(day, args[2])
+	if !end.After(start) {
+		end = atClock(day.AddDate(0, 0, 1), args[2])
+	}
+
+	cover, ok := oncallersByCode[strings.ToLower(args[3])]
+	if !ok {
+		return fmt.Errorf("unknown oncaller %q", args[3])
+	}
+	current, err := oncallAt(cal, start)
+	if err != nil {
+		return err
+	}
+	covered := current.Victim
+	if len(args) == 6 && !strings.EqualFold(covered.Code, args[5]) {
+		return fmt.Errorf("%s is oncall at %s, not %s", covered.Code,
+			start.Format("2006-01-02 15:04"), args[5])
+	}
+	if covered.Code == cover.Code {
+		return fmt.Errorf("%s is oncall then anyway", cover.Code)
+	}
+	away, err := getAwayList(cal, day)
+	if err != nil {
+		return err
+	}
+	if isListed(strings.ToLower(cover.Code), away) {
+		return fmt.Errorf("%s is away on %s", cover.Code, dateFormat(day))
+	}
+
+	title := fmt.Sprintf("%s cover-fix", cover.Code)
+	if covered.Code != "" {
+		title += " for " + covered.Code
+	}
+	err = cal.InsertEvent(config.OncallCalendar, &calendarEvent{
+		Summary:   title,
+		Start:     start,
+		End:       end,
+		Attendees: makeAttendees([]oncallPerson{cover}),
+	})
+	writeAudit(auditEntry{Target: "calendar", Role: "cover", Day: dateFormat(day),
+		Old: covered.Code, New: cover.Code, Reason: "cover", Start: &start, End: &end,
+		Failed: err != nil})
+	if err != nil {
+		return err
+	}
+	if config.OpsGenie.APIKey != "" {
+		if err := setOpsgenieCover(start, end, cover.Email); err != nil {
+			return fmt.Errorf("added to the calendar, but %s", err)
+		}
+	}
+	fmt.Printf("%s: %s covers %s-%s for %s\n", day.Format("Mon 2006-01-02"), cover.Code,
+		start.Format("15:04"), end.Format("15:04"), covered.Code)
+	return nil
+}
+
+// coverAt returns whoever is covering at t, if anyone is.
+func coverAt(cal CalendarBackend, t time.Time) (oncallPerson, bool, error) {
+	events, err := cal.ListEvents(config.OncallCalendar, t, t.Add(time.Minute))
+	if err != nil {
+		return oncallPerson{}, false, fmt.Errorf("couldn't get entries from oncall calendar: %s", err)
+	}
+	for _, event := range events {
+		if event.AllDay || t.Before(event.Start) || !t.Before(event.End) {
+			continue
+		}
+		if match := coverRe.FindStringSubmatch(event.Summary); match != nil {
+			if person, ok := oncallersByCode[strings.ToLower(match[1])]; ok {
+				return person, true, nil
+			}
+		}
+	}
+	return oncallPerson{}, false, nil
+}
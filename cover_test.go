@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCoverDryRun(t *testing.T) {
+	og := &ogOverrideServer{}
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		og.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	saved := ogURLPrefix
+	ogURLPrefix = srv.URL
+	defer func() { ogURLPrefix = saved }()
+
+	f := setupTest(t, "Europe/Vienna")
+	baseConfig.OpsGenie = ogConfig{APIKey: "key", ScheduleID: "schedule",
+		WeekdaySchedule: "weekday", WeekendSchedule: "weekend"}
+	for i := range baseConfig.Oncallers {
+		baseConfig.Oncallers[i].Email = baseConfig.Oncallers[i].Code + "@example.com"
+	}
+	useRotation(rotationConfig{})
+	f.add("oncall", allDayEvent("aa onduty", "2026-11-03", "2026-11-04"))
+	args := []string{"2026-11-03", "14:00", "18:00", "jd", "for", "aa"}
+
+	*flagDryRun = true
+	err := overrideCommand(f, args)
+	*flagDryRun = false
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 0 {
+		t.Errorf("dry run sent %d requests to OpsGenie", requests)
+	}
+
+	// For real, it does.
+	if err := overrideCommand(f, args); err != nil {
+		t.Fatal(err)
+	}
+	if len(og.created) != 1 || og.created[0].User.Username != "jd@example.com" {
+		t.Errorf("overrides created: %+v", og.created)
+	}
+}
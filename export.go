@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Write iCalendar feeds of the rota: oncall.ics for the whole team, and
+// oncall-<code>.ics per oncaller containing only their days. Every day
+// has the same UID in every feed and every run, so re-importing a feed
+// updates events rather than duplicating them.
+func writeICSFeeds(dir string, days map[string]*oncallDay, people []oncallPerson) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	dates := []string{}
+	for date, day := range days {
+		if day != nil && day.Victim.Code != "" {
+			dates = append(dates, date)
+		}
+	}
+	sort.Strings(dates)
+
+	team := newFeed("Oncall rota")
+	personal := make(map[string]*icsCalendar)
+	for _, person := range people {
+		personal[person.Code] = newFeed(fmt.Sprintf("Oncall rota (%s)", person.Code))
+	}
+
+	for _, date := range dates {
+		start, err := parseDate(date)
+		if err != nil {
+			continue
+		}
+		victim := days[date].Victim
+		uid := fmt.Sprintf("oncall-%s%s@rotator", start.Format(icsDateString), regionSlug())
+		team.events = append(team.events, feedEvent(uid, victim.Code+" onduty"+regionTag(), start))
+		if feed, ok := personal[victim.Code]; ok {
+			feed.events = append(feed.events, feedEvent(uid, "onduty"+regionTag(), start))
+		}
+	}
+
+	err = writeFeed(filepath.Join(dir, "oncall.ics"), team)
+	if err != nil {
+		return err
+	}
+	for code, feed := range personal {
+		err = writeFeed(filepath.Join(dir, "oncall-"+strings.ToLower(code)+".ics"), feed)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newFeed(name string) *icsCalendar {
+	return &icsCalendar{header: []string{
+		"VERSION:2.0",
+		"PRODID:-//uffish//rotator//EN",
+		"X-WR-CALNAME:" + escapeICS(name),
+	}}
+}
+
+func feedEvent(uid string, summary string, day time.Time) *icsEvent {
+	start, end, allDay := roleWindow(day)
+	return &icsEvent{
+		UID: uid,
+		event: &calendarEvent{
+			Summary: summary,
+			Start:   start,
+			End:     end,
+			AllDay:  allDay,
+		},
+		extra: []string{"TRANSP:TRANSPARENT"},
+	}
+}
+
+// writeFeed replaces the feed in one go, so that whatever serves it never
+// hands out half a file.
+func writeFeed(path string, feed *icsCalendar) error {
+	if *flagDebug {
+		fmt.Printf("Writing %d events to %s\n", len(feed.events), path)
+	}
+	return writeFileAtomic(path, feed.encode())
+}
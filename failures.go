@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// When writing a day to the calendar or OpsGenie fails, the run carries on
+// with the next day (-on_error=continue), or stops there (-on_error=stop).
+// Either way rotator ends with a list of what failed and a non-zero exit
+// status.
+type runFailure struct {
+	Rotation string
+	Day      string
+	Target   string // "calendar", "opsgenie", "mail" or "slack"
+	Err      error
+}
+
+func (f runFailure) String() string {
+	s := f.Target
+	if f.Rotation != "" {
+		s = "[" + f.Rotation + "] " + s
+	}
+	if f.Day != "" {
+		s += " " + f.Day
+	}
+	return s + ": " + f.Err.Error()
+}
+
+var failures []runFailure
+
+// errStopped is returned all the way up once a failure stops the run.
+var errStopped = errors.New("stopped after failure")
+
+// failDay notes that target couldn't be updated for day (which may be
+// zero, for failures that aren't about any one day). It returns
+// errStopped if the run should stop, and nil if it should carry on.
+func failDay(day time.Time, target string, err error) error {
+	f := runFailure{Rotation: stateKey(), Target: target, Err: err}
+	if !day.IsZero() {
+		f.Day = dateFormat(day)
+	}
+	failures = append(failures, f)
+	fmt.Printf("Error: %s\n", f)
+	if *flagOnError == "stop" {
+		return errStopped
+	}
+	return nil
+}
+
+// failureSummary lists everything that went wrong in this run.
+func failureSummary() {
+	fmt.Printf("%d failures:\n", len(failures))
+	for _, f := range failures {
+		fmt.Printf("  %s\n", f)
+	}
+	if *flagOnError == "stop" {
+		fmt.Println("Stopped at the first failure (-on_error=stop).")
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The "fair" scheduler plans the whole window at once instead of walking
+// the rotation greedily. It tries to even out the number of days, weekend
+// days and public holidays everyone has done over a rolling window that
+// includes FairnessWindow days of history, while leaving fixed days alone
+// and never booking anyone who is away, never covers that weekday or has a
+// holiday where they live. Monthly limits are kept to as the plan is made
+// (see fairBooked); rest and consecutive days are left to the score.
+
+// Relative weights of the terms of the fairness score. Breaking someone's
+// MaxConsecutiveDays or MinRestDays costs so much it only happens when
+// there's no alternative.
+var fairWeightDays = float64(1)
+var fairWeightWeekends = float64(2)
+var fairWeightHolidays = float64(3)
+var fairWeightBackToBack = float64(0.5)
+var fairWeightPreferred = float64(0.25)
+var fairWeightPersonal = float64(100)
+
+type fairLoad struct {
+	Days     int
+	Weekends int
+	Holidays int
+}
+
+type fairDay struct {
+	day       time.Time
+	fixed     bool
+	weekend   bool
+	holiday   bool
+	workday   bool
+	available []string // codes of everyone who could do this day
+	victim    string
+}
+
+// rotateFair plans and writes days days starting at first. Days whose
+// availability can't be read are left as they are.
+func rotateFair(cal CalendarBackend, first time.Time, days int) error {
+	window := config.FairnessWindow
+	if window == 0 {
+		window = 90
+	}
+
+	// Count history, fetching whatever the prefetch didn't cover (and
+	// filling in from the state file where the calendar has gaps).
+	history := make(map[string]*fairLoad)
+	for _, person := range config.Oncallers {
+		history[person.Code] = &fairLoad{}
+	}
+	if err := loadRange(cal, config.OncallCalendar, dayStart(first.AddDate(0, 0, -window-1)), dayStart(first)); err != nil {
+		return err
+	}
+	for x := window; x > 0; x-- {
+		day := first.AddDate(0, 0, -x)
+		if _, ok := oncall.Days[dateFormat(day)]; !ok {
+			d, err := getOncallByDay(cal, day)
+			if err != nil {
+				return err
+			}
+			oncall.Days[dateFormat(day)] = d
+			reconcileDay(day, d)
+		}
+		if load, ok := history[pastOncall(day).Code]; ok {
+			addFairLoad(load, isWeekend(day), isPublicHoliday(day), 1)
+		}
+	}
+
+	plan := []*fairDay{}
+	for x := 0; x < days; x++ {
+		day := first.AddDate(0, 0, x)
+		fd := &fairDay{
+			day:     day,
+			weekend: isWeekend(day),
+			holiday: isPublicHoliday(day),
+			workday: isWorkday(day),
+		}
+		existing := oncall.Days[dateFormat(day)]
+		if existing.Fixed {
+			fd.fixed = true
+			fd.victim = existing.Victim.Code
+		} else {
+			away, err := getAwayList(cal, day)
+			if err != nil {
+				if err := failDay(day, "calendar", err); err != nil {
+					return err
+				}
+				fd.fixed = true
+				fd.victim = existing.Victim.Code
+				plan = append(plan, fd)
+				continue
+			}
+			for x := 0; x < len(oncallersByOrder); x++ {
+				person := oncallersByOrder[x]
+				if !isListed(strings.ToLower(person.Code), away) && !hasWeekday(person.NeverWeekdays, day) &&
+					!isRegionalHoliday(person, day) {
+					fd.available = append(fd.available, person.Code)
+				}
+			}
+		}
+		plan = append(plan, fd)
+	}
+
+	previous := ""
+	if d, ok := oncall.Days[dateFormat(first.AddDate(0, 0, -1))]; ok {
+		previous = d.Victim.Code
+	}
+	planFair(plan, history, previous, fairBookings(cal, plan))
+
+	for _, fd := range plan {
+		if *flagVerbose == true {
+			status := ""
+			if fd.fixed {
+				status = "Fixed,"
+			}
+			fmt.Printf("%s: %s # %sAvailable: %s\n",
+				fd.day.Format("Mon 2006-01-02"),
+				fd.victim,
+				status,
+				strings.Join(fd.available, ","))
+		}
+		if fd.fixed {
+			continue
+		}
+		victim, ok := oncallersByCode[fd.victim]
+		if !ok {
+			victim = oncallerShadow
+		}
+		if err := assignDay(cal, fd.day, victim); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addFairLoad(load *fairLoad, weekend bool, holiday bool, delta int) {
+	load.Days += delta
+	if weekend {
+		load.Weekends += delta
+	}
+	if holiday {
+		load.Holidays += delta
+	}
+}
+
+// planFair fills in victim for every non-fixed day of plan: first
+// greedily (least loaded available person, ties going to whoever is next
+// in the rotation), then by moving and swapping days for as long as that
+// improves the overall score. Nobody is planned past their monthly limits.
+func planFair(plan []*fairDay, history map[string]*fairLoad, previous string, booked fairBooked) {
+	load := make(map[string]*fairLoad)
+	for code, h := range history {
+		l := *h
+		load[code] = &l
+	}
+	for _, fd := range plan {
+		if fd.fixed {
+			if l, ok := load[fd.victim]; ok {
+				addFairLoad(l, fd.weekend, fd.holiday, 1)
+			}
+		}
+	}
+
+	for i, fd := range plan {
+		if fd.fixed {
+			previous = fd.victim
+			continue
+		}
+		if len(fd.available) == 0 {
+			fd.victim = oncallerShadow.Code
+			previous = ""
+			continue
+		}
+		// Like the rotation scheduler, keep the same person over holidays.
+		if !fd.workday && i > 0 && isListed(previous, fd.available) && !plan[i-1].fixed &&
+			!booked.overLimit(plan, i, previous) {
+			fd.victim = previous
+			addFairLoad(load[previous], fd.weekend, fd.holiday, 1)
+			continue
+		}
+		best := ""
+		bestScore := float64(0)
+		for _, code := range rotationOrderAfter(previous) {
+			if !isListed(code, fd.available) || booked.overLimit(plan, i, code) {
+				continue
+			}
+			l := load[code]
+			person := oncallersByCode[code]
+			weight := personWeight(person)
+			score := float64(l.Days) / weight
+			if fd.weekend {
+				score += fairWeightWeekends * float64(l.Weekends) / weight
+			}
+			if fd.holiday {
+				score += fairWeightHolidays * float64(l.Holidays) / weight
+			}
+			if hasWeekday(person.PreferredWeekdays, fd.day) {
+				score -= fairWeightPreferred
+			}
+			if best == "" || score < bestScore {
+				best = code
+				bestScore = score
+			}
+		}
+		if best == "" {
+			fd.victim = oncallerShadow.Code
+			previous = ""
+			continue
+		}
+		fd.victim = best
+		addFairLoad(load[best], fd.weekend, fd.holiday, 1)
+		previous = best
+	}
+
+	improveFair(plan, load, booked)
+}
+
+// fairBooked holds everyone's bookings per month ("2006-01") that the plan
+// doesn't replace, i.e. those on days outside it and on its fixed days.
+type fairBooked map[string]map[string]*restriction
+
+func fairBookings(cal CalendarBackend, plan []*fairDay) fairBooked {
+	booked := make(fairBooked)
+	if config.MaxDaysPerMonth+config.MaxWeekendsPerMonth == 0 {
+		return booked
+	}
+	for _, fd := range plan {
+		month := fd.day.Format("2006-01")
+		if _, ok := booked[month]; !ok {
+			booked[month] = getOncallMonthRestrictions(cal, fd.day)
+		}
+		if fd.fixed {
+			continue
+		}
+		// this day's current oncaller is about to be replaced
+		if r, ok := booked[month][pastOncall(fd.day).Code]; ok {
+			r.DaysBooked--
+			if fd.weekend {
+				r.WeekendsBooked--
+			}
+		}
+	}
+	return booked
+}
+
+// overLimit reports whether plan[i] would take code over their monthly
+// limits, counting the rest of the plan as it stands.
+func (booked fairBooked) overLimit(plan []*fairDay, i int, code string) bool {
+	fd := plan[i]
+	month := fd.day.Format("2006-01")
+	r, ok := booked[month][code]
+	if !ok {
+		return false
+	}
+	days, weekends := r.DaysBooked, r.WeekendsBooked
+	for j, other := range plan {
+		if j == i || other.victim != code || other.day.Format("2006-01") != month {
+			continue
+		}
+		days++
+		if other.weekend {
+			weekends++
+		}
+	}
+	person := oncallersByCode[code]
+	return (config.MaxDaysPerMonth > 0 && days >= personLimit(config.MaxDaysPerMonth, person)) ||
+		(fd.weekend && config.MaxWeekendsPerMonth > 0 && weekends >= personLimit(config.MaxWeekendsPerMonth, person))
+}
+
+// rotationOrderAfter lists everyone's code in rotation order, starting
+// with whoever follows previous.
+func rotationOrderAfter(previous string) []string {
+	start := 0
+	if p, ok := oncallersByCode[previous]; ok {
+		start = p.Order + 1
+	}
+	order := []string{}
+	for x := 0; x < len(oncallersByOrder); x++ {
+		order = append(order, oncallersByOrder[(start+x)%len(oncallersByOrder)].Code)
+	}
+	return order
+}
+
+// fairScore is what we minimise: the weighted variance of days, weekend
+// days and holidays across people (relative to their weight), plus a
+// small penalty for working back-to-back days (other than over weekends
+// and holidays) and a small bonus for working preferred days.
+func fairScore(plan []*fairDay, load map[string]*fairLoad) float64 {
+	variance := func(get func(*fairLoad) float64) float64 {
+		sum, sumsq := float64(0), float64(0)
+		for code, l := range load {
+			v := get(l) / personWeight(oncallersByCode[code])
+			sum += v
+			sumsq += v * v
+		}
+		n := float64(len(load))
+		if n == 0 {
+			return 0
+		}
+		mean := sum / n
+		return sumsq/n - mean*mean
+	}
+	score := fairWeightDays*variance(func(l *fairLoad) float64 { return float64(l.Days) }) +
+		fairWeightWeekends*variance(func(l *fairLoad) float64 { return float64(l.Weekends) }) +
+		fairWeightHolidays*variance(func(l *fairLoad) float64 { return float64(l.Holidays) })
+	for i := 1; i < len(plan); i++ {
+		if plan[i].workday && plan[i].victim == plan[i-1].victim {
+			score += fairWeightBackToBack
+		}
+	}
+	for i, fd := range plan {
+		person, ok := oncallersByCode[fd.victim]
+		if !ok {
+			continue
+		}
+		if hasWeekday(person.PreferredWeekdays, fd.day) {
+			score -= fairWeightPreferred
+		}
+		if !fd.fixed && fairPersonalBlock(plan, i, person) {
+			score += fairWeightPersonal
+		}
+	}
+	return score
+}
+
+// fairPersonalBlock checks MaxConsecutiveDays and MinRestDays for plan[i],
+// looking at the plan itself and the calendar before it.
+func fairPersonalBlock(plan []*fairDay, i int, person oncallPerson) bool {
+	worked := func(x int) bool {
+		if x >= 0 {
+			return plan[x].victim == person.Code
+		}
+		return wasOncall(person.Code, plan[0].day.AddDate(0, 0, x))
+	}
+	if person.MaxConsecutiveDays > 0 {
+		run := 0
+		for run < person.MaxConsecutiveDays && worked(i-run-1) {
+			run++
+		}
+		if run >= person.MaxConsecutiveDays {
+			return true
+		}
+	}
+	if person.MinRestDays > 0 && !worked(i-1) {
+		for x := 2; x <= person.MinRestDays+1; x++ {
+			if worked(i - x) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func improveFair(plan []*fairDay, load map[string]*fairLoad, booked fairBooked) {
+	reassign := func(fd *fairDay, code string) {
+		if l, ok := load[fd.victim]; ok {
+			addFairLoad(l, fd.weekend, fd.holiday, -1)
+		}
+		fd.victim = code
+		if l, ok := load[code]; ok {
+			addFairLoad(l, fd.weekend, fd.holiday, 1)
+		}
+	}
+
+	current := fairScore(plan, load)
+	for pass := 0; pass < 20; pass++ {
+		improved := false
+		// Move single days to someone else.
+		for i, fd := range plan {
+			if fd.fixed || len(fd.available) == 0 {
+				continue
+			}
+			for _, code := range fd.available {
+				old := fd.victim
+				if code == old || booked.overLimit(plan, i, code) {
+					continue
+				}
+				reassign(fd, code)
+				if score := fairScore(plan, load); score < current-1e-9 {
+					current = score
+					improved = true
+				} else {
+					reassign(fd, old)
+				}
+			}
+		}
+		// Swap pairs of days between people.
+		for i, a := range plan {
+			for j := i + 1; j < len(plan); j++ {
+				b := plan[j]
+				if a.fixed || b.fixed || a.victim == b.victim ||
+					!isListed(a.victim, b.available) || !isListed(b.victim, a.available) {
+					continue
+				}
+				va, vb := a.victim, b.victim
+				reassign(a, vb)
+				reassign(b, va)
+				if booked.overLimit(plan, i, vb) || booked.overLimit(plan, j, va) {
+					reassign(a, va)
+					reassign(b, vb)
+					continue
+				}
+				if score := fairScore(plan, load); score < current-1e-9 {
+					current = score
+					improved = true
+				} else {
+					reassign(a, va)
+					reassign(b, vb)
+				}
+			}
+		}
+		if !improved {
+			break
+		}
+	}
+	if *flagDebug {
+		fmt.Printf("Fair schedule score: %.3f\n", current)
+		for code, l := range load {
+			fmt.Printf("Oncaller: %s Days: %d WE: %d Hol: %d\n", code, l.Days, l.Weekends, l.Holidays)
+		}
+	}
+}
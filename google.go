@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// googleBackend is the Google Calendar v3 implementation of CalendarBackend.
+type googleBackend struct {
+	srv *calendar.Service
+}
+
+// ListEvents fetches every page of results, so it can be asked for
+// months at a time.
+func (g *googleBackend) ListEvents(calendarID string, start time.Time, end time.Time) ([]*calendarEvent, error) {
+	result := []*calendarEvent{}
+	pageToken := ""
+	for {
+		call := g.srv.Events.List(calendarID).
+			SingleEvents(true).
+			TimeMax(end.Format(time.RFC3339)).
+			TimeMin(start.Format(time.RFC3339)).
+			MaxResults(2500).
+			OrderBy("startTime")
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		events, err := call.Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range events.Items {
+			result = append(result, fromGoogleEvent(item))
+		}
+		pageToken = events.NextPageToken
+		if pageToken == "" {
+			return result, nil
+		}
+	}
+}
+
+// SyncEvents lists what changed since token, or without one, everything
+// from from on (which also gets us a first token).
+func (g *googleBackend) SyncEvents(calendarID string, from time.Time, token string) ([]*calendarEvent, []string, string, error) {
+	changed := []*calendarEvent{}
+	deleted := []string{}
+	pageToken := ""
+	for {
+		call := g.srv.Events.List(calendarID).
+			SingleEvents(true).
+			MaxResults(2500)
+		if token != "" {
+			call = call.SyncToken(token)
+		} else {
+			call = call.TimeMin(from.Format(time.RFC3339))
+		}
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		events, err := call.Do()
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusGone {
+			return nil, nil, "", errSyncExpired
+		}
+		if err != nil {
+			return nil, nil, "", err
+		}
+		for _, item := range events.Items {
+			if item.Status == "cancelled" {
+				deleted = append(deleted, item.Id)
+				continue
+			}
+			changed = append(changed, fromGoogleEvent(item))
+		}
+		pageToken = events.NextPageToken
+		if pageToken == "" {
+			return changed, deleted, events.NextSyncToken, nil
+		}
+	}
+}
+
+// WatchEvents registers a push channel for changes to the calendar.
+func (g *googleBackend) WatchEvents(calendarID string, channelID string, address string, token string, ttl time.Duration) (*watchChannel, error) {
+	channel := &calendar.Channel{
+		Id:      channelID,
+		Type:    "web_hook",
+		Address: address,
+		Token:   token,
+		Params:  map[string]string{"ttl": strconv.Itoa(int(ttl.Seconds()))},
+	}
+	result, err := g.srv.Events.Watch(calendarID, channel).Do()
+	if err != nil {
+		return nil, err
+	}
+	expires := time.Now().Add(ttl)
+	if result.Expiration != 0 {
+		expires = time.Unix(0, result.Expiration*int64(time.Millisecond))
+	}
+	return &watchChannel{ID: result.Id, ResourceID: result.ResourceId, Calendar: calendarID, Expires: expires}, nil
+}
+
+func (g *googleBackend) StopWatch(channel *watchChannel) error {
+	return g.srv.Channels.Stop(&calendar.Channel{Id: channel.ID, ResourceId: channel.ResourceID}).Do()
+}
+
+func (g *googleBackend) InsertEvent(calendarID string, event *calendarEvent) error {
+	if *flagDryRun {
+		return nil
+	}
+	newEvent := &calendar.Event{}
+	toGoogleEvent(event, newEvent)
+	created, err := g.srv.Events.Insert(calendarID, newEvent).Do()
+	if err != nil {
+		return err
+	}
+	event.ID = created.Id
+	return nil
+}
+
+// UpdateEvent fetches the stored event first so that fields we don't
+// manage (description, reminders etc.) survive the rewrite.
+func (g *googleBackend) UpdateEvent(calendarID string, event *calendarEvent) error {
+	if *flagDryRun {
+		return nil
+	}
+	existing, err := g.srv.Events.Get(calendarID, event.ID).Do()
+	if err != nil {
+		return err
+	}
+	toGoogleEvent(event, existing)
+	_, err = g.srv.Events.Update(calendarID, event.ID, existing).Do()
+	return err
+}
+
+func (g *googleBackend) DeleteEvent(calendarID string, eventID string) error {
+	if *flagDryRun {
+		return nil
+	}
+	return g.srv.Events.Delete(calendarID, eventID).Do()
+}
+
+func fromGoogleEvent(item *calendar.Event) *calendarEvent {
+	event := &calendarEvent{
+		ID:      item.Id,
+		Summary: item.Summary,
+	}
+	if item.Start != nil && item.Start.DateTime == "" {
+		// All-day events have no associated time, just a date
+		event.AllDay = true
+		event.Start, _ = parseDate(item.Start.Date)
+		if item.End != nil {
+			event.End, _ = parseDate(item.End.Date)
+		}
+	} else {
+		if item.Start != nil {
+			event.Start, _ = time.Parse(time.RFC3339, item.Start.DateTime)
+		}
+		if item.End != nil {
+			event.End, _ = time.Parse(time.RFC3339, item.End.DateTime)
+		}
+	}
+	for _, attendee := range item.Attendees {
+		event.Attendees = append(event.Attendees, attendee.Email)
+	}
+	return event
+}
+
+func toGoogleEvent(event *calendarEvent, item *calendar.Event) {
+	item.Summary = event.Summary
+	if event.AllDay {
+		item.Start = &calendar.EventDateTime{Date: dateFormat(event.Start)}
+		item.End = &calendar.EventDateTime{Date: dateFormat(event.End)}
+	} else {
+		item.Start = &calendar.EventDateTime{DateTime: event.Start.Format(time.RFC3339)}
+		item.End = &calendar.EventDateTime{DateTime: event.End.Format(time.RFC3339)}
+	}
+	item.Attendees = nil
+	for _, email := range event.Attendees {
+		item.Attendees = append(item.Attendees, &calendar.EventAttendee{Email: email})
+	}
+}
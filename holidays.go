@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/uffish/holidays"
+	"github.com/uffish/holidays/austria"
+	"gopkg.in/yaml.v1"
+)
+
+// Extra public holidays from HolidayFiles, and regional holidays per
+// HolidayRegions entry, as sets of dates (YYYY-MM-DD).
+var extraHolidays map[string]bool
+var regionHolidays map[string]map[string]bool
+
+// loadHolidays sets up the holiday calendars for the active rotation.
+func loadHolidays() error {
+	extraHolidays = make(map[string]bool)
+	for _, fn := range config.HolidayFiles {
+		dates, err := readHolidayFile(fn)
+		if err != nil {
+			return err
+		}
+		for d := range dates {
+			extraHolidays[d] = true
+		}
+	}
+
+	regionHolidays = make(map[string]map[string]bool)
+	for region, fn := range config.HolidayRegions {
+		dates, err := readHolidayFile(fn)
+		if err != nil {
+			return err
+		}
+		regionHolidays[strings.ToLower(region)] = dates
+	}
+	return nil
+}
+
+// readHolidayFile reads a list of dates from an iCalendar file (every day
+// covered by an all-day event) or a YAML file, which is either a plain
+// list of dates or a list of {date, name} entries.
+func readHolidayFile(fn string) (map[string]bool, error) {
+	dates := make(map[string]bool)
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.ToLower(filepath.Ext(fn)) == ".ics" {
+		ics, err := parseICS(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fn, err)
+		}
+		for _, e := range ics.events {
+			if !e.event.AllDay {
+				continue
+			}
+			for d := e.event.Start; d.Before(e.event.End); d = d.AddDate(0, 0, 1) {
+				dates[dateFormat(d)] = true
+			}
+		}
+		return dates, nil
+	}
+
+	var entries []interface{}
+	if err := yaml.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	for _, entry := range entries {
+		d := fmt.Sprint(entry)
+		if m, ok := entry.(map[interface{}]interface{}); ok {
+			d = fmt.Sprint(m["date"])
+		}
+		t, err := time.Parse("2006-01-02", d)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad date %q", fn, d)
+		}
+		dates[dateFormat(t)] = true
+	}
+	return dates, nil
+}
+
+// A public holiday is a weekday that isn't a business day.
+func isPublicHoliday(day time.Time) bool {
+	if isWeekend(day) {
+		return false
+	}
+	if extraHolidays[dateFormat(day)] {
+		return true
+	}
+	if config.AustrianHolidays != nil && !*config.AustrianHolidays {
+		return false
+	}
+	return !holidays.CheckIsBusinessDay(day, austria.GetHolidays())
+}
+
+// isRegionalHoliday reports whether day is a holiday where person lives.
+func isRegionalHoliday(person oncallPerson, day time.Time) bool {
+	if person.HolidayRegion == "" {
+		return false
+	}
+	return regionHolidays[strings.ToLower(person.HolidayRegion)][dateFormat(day)]
+}
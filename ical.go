@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var icsDateString = string("20060102")
+var icsTimeString = string("20060102T150405")
+var icsUTCTimeString = string("20060102T150405Z")
+
+// icsCalendar is a parsed iCalendar object. We only manage a handful of
+// VEVENT properties; everything else (VTIMEZONE components, DESCRIPTION,
+// ALARMs, ...) is kept verbatim so that rewriting a file loses nothing.
+// Events we haven't changed are written back exactly as they were read,
+// and so is everything around them.
+// Recurrence rules are not expanded here (the CalDAV backend has the server
+// do that).
+type icsCalendar struct {
+	header []string // VCALENDAR properties
+	other  []string // components other than VEVENT, raw lines
+	events []*icsEvent
+	// The data as read, in order: the text between events, and the
+	// events. New events go in at insertAt (before END:VCALENDAR).
+	layout   []icsChunk
+	insertAt int
+}
+
+type icsChunk struct {
+	text  string
+	event *icsEvent
+}
+
+type icsEvent struct {
+	UID   string
+	event *calendarEvent
+	extra []string // unmanaged property lines and sub-components
+	// Recurrence identifies an instance of a recurring event (its
+	// RECURRENCE-ID, see recurrenceKey); empty for the event itself.
+	Recurrence string
+	// the ATTENDEE lines as read, by address, to keep their parameters
+	attendees map[string]string
+	// The event as read, text and all. Its times' TZID (or floating, if
+	// they had none and weren't UTC) is kept for when we do change it, so
+	// that they still line up with any RRULE or EXDATE.
+	raw       string
+	orig      *calendarEvent
+	origExtra []string
+	tzid      string
+	floating  bool
+}
+
+// icsLine is a logical line, and the text it came from (folds, line
+// endings and any blank lines that followed included).
+type icsLine struct {
+	text string
+	raw  string
+}
+
+// unfoldICS splits iCalendar data into logical lines, joining continuation
+// lines (those starting with a space or tab) onto their predecessor.
+func unfoldICS(data []byte) []string {
+	lines := []string{}
+	for _, l := range unfoldICSLines(data) {
+		lines = append(lines, l.text)
+	}
+	return lines
+}
+
+func unfoldICSLines(data []byte) []icsLine {
+	lines := []icsLine{}
+	leading := ""
+	reader := bufio.NewReader(bytes.NewReader(data))
+	for {
+		raw, err := reader.ReadString('\n')
+		if raw == "" && err != nil {
+			break
+		}
+		line := strings.TrimRight(raw, "\r\n")
+		switch {
+		case (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0:
+			lines[len(lines)-1].text += line[1:]
+			lines[len(lines)-1].raw += raw
+		case line == "" && len(lines) > 0:
+			lines[len(lines)-1].raw += raw
+		case line == "":
+			leading += raw
+		default:
+			lines = append(lines, icsLine{text: line, raw: leading + raw})
+			leading = ""
+		}
+	}
+	return lines
+}
+
+// splitICSLine splits "NAME;PARAM=x:value" into name, params and value.
+func splitICSLine(line string) (string, map[string]string, string) {
+	params := make(map[string]string)
+	colon := strings.Index(line, ":")
+	if colon < 0 {
+		return strings.ToUpper(line), params, ""
+	}
+	value := line[colon+1:]
+	parts := strings.Split(line[:colon], ";")
+	for _, p := range parts[1:] {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return strings.ToUpper(parts[0]), params, value
+}
+
+func parseICSTime(params map[string]string, value string) (time.Time, bool, error) {
+	if params["VALUE"] == "DATE" || len(value) == len(icsDateString) {
+		// dates are taken to be in the rota's time zone
+		t, err := time.ParseInLocation(icsDateString, value, rotaLocation)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse(icsUTCTimeString, value)
+		return t, false, err
+	}
+	loc := time.Local
+	if params["TZID"] != "" {
+		if l, err := time.LoadLocation(params["TZID"]); err == nil {
+			loc = l
+		}
+	}
+	t, err := time.ParseInLocation(icsTimeString, value, loc)
+	return t, false, err
+}
+
+func unescapeICS(value string) string {
+	r := strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+	return r.Replace(value)
+}
+
+func escapeICS(value string) string {
+	r := strings.NewReplacer(`\`, `\\`, "\n", `\n`, ",", `\,`, ";", `\;`)
+	return r.Replace(value)
+}
+
+func parseICS(data []byte) (*icsCalendar, error) {
+	cal := &icsCalendar{}
+	var current *icsEvent
+	depth := 0 // nesting below the current top-level component
+	inCalendar := false
+	var otherComponent []string
+	var pending, eventRaw strings.Builder
+	ended := false
+
+	for _, l := range unfoldICSLines(data) {
+		line := l.text
+		name, params, value := splitICSLine(line)
+		switch {
+		case current != nil:
+			eventRaw.WriteString(l.raw)
+		case inCalendar && otherComponent == nil && name == "BEGIN" && strings.ToUpper(value) == "VEVENT":
+			cal.layout = append(cal.layout, icsChunk{text: pending.String()})
+			pending.Reset()
+			eventRaw.Reset()
+			eventRaw.WriteString(l.raw)
+		default:
+			if !ended && name == "END" && strings.ToUpper(value) == "VCALENDAR" {
+				cal.layout = append(cal.layout, icsChunk{text: pending.String()})
+				pending.Reset()
+				cal.insertAt = len(cal.layout)
+				ended = true
+			}
+			pending.WriteString(l.raw)
+		}
+		switch {
+		case name == "BEGIN" && strings.ToUpper(value) == "VCALENDAR":
+			inCalendar = true
+			continue
+		case name == "END" && strings.ToUpper(value) == "VCALENDAR":
+			inCalendar = false
+			continue
+		}
+		if !inCalendar {
+			continue
+		}
+		if current == nil && otherComponent == nil {
+			if name == "BEGIN" && strings.ToUpper(value) == "VEVENT" {
+				current = &icsEvent{event: &calendarEvent{}}
+				continue
+			}
+			if name == "BEGIN" {
+				otherComponent = []string{line}
+				continue
+			}
+			cal.header = append(cal.header, line)
+			continue
+		}
+		if otherComponent != nil {
+			otherComponent = append(otherComponent, line)
+			if name == "BEGIN" {
+				depth++
+			} else if name == "END" {
+				if depth == 0 {
+					cal.other = append(cal.other, otherComponent...)
+					otherComponent = nil
+				} else {
+					depth--
+				}
+			}
+			continue
+		}
+		// inside a VEVENT
+		if depth > 0 || (name == "BEGIN") {
+			current.extra = append(current.extra, line)
+			if name == "BEGIN" {
+				depth++
+			} else if name == "END" {
+				depth--
+			}
+			continue
+		}
+		switch name {
+		case "END":
+			if current.event.End.IsZero() {
+				if current.event.AllDay {
+					current.event.End = current.event.Start.AddDate(0, 0, 1)
+				} else {
+					current.event.End = current.event.Start
+				}
+			}
+			current.raw = eventRaw.String()
+			current.orig = copyEvent(current.event)
+			current.origExtra = append([]string{}, current.extra...)
+			cal.events = append(cal.events, current)
+			cal.layout = append(cal.layout, icsChunk{event: current})
+			current = nil
+		case "UID":
+			current.UID = value
+		case "SUMMARY":
+			current.event.Summary = unescapeICS(value)
+		case "DTSTART":
+			t, allday, err := parseICSTime(params, value)
+			if err != nil {
+				return nil, fmt.Errorf("bad DTSTART %q: %s", value, err)
+			}
+			current.event.Start = t
+			current.event.AllDay = allday
+			if !allday {
+				current.tzid = params["TZID"]
+				current.floating = params["TZID"] == "" && !strings.HasSuffix(value, "Z")
+			}
+		case "DTEND":
+			t, _, err := parseICSTime(params, value)
+			if err != nil {
+				return nil, fmt.Errorf("bad DTEND %q: %s", value, err)
+			}
+			current.event.End = t
+		case "ATTENDEE":
+			if strings.HasPrefix(strings.ToLower(value), "mailto:") {
+				address := value[len("mailto:"):]
+				current.event.Attendees = append(current.event.Attendees, address)
+				if current.attendees == nil {
+					current.attendees = make(map[string]string)
+				}
+				current.attendees[strings.ToLower(address)] = line
+			}
+		case "RECURRENCE-ID":
+			t, allday, err := parseICSTime(params, value)
+			if err != nil {
+				return nil, fmt.Errorf("bad RECURRENCE-ID %q: %s", value, err)
+			}
+			current.Recurrence = recurrenceKey(t, allday)
+			current.extra = append(current.extra, line)
+		default:
+			current.extra = append(current.extra, line)
+		}
+	}
+	if current != nil || otherComponent != nil {
+		return nil, fmt.Errorf("unterminated component in calendar data")
+	}
+	cal.layout = append(cal.layout, icsChunk{text: pending.String()})
+	if !ended {
+		// not something we can safely add to, write it out afresh
+		cal.layout = nil
+	}
+	return cal, nil
+}
+
+// foldICS splits a content line into 75-octet chunks as RFC 5545 requires.
+func foldICS(line string) string {
+	if len(line) <= 75 {
+		return line + "\r\n"
+	}
+	var b strings.Builder
+	first := true
+	for len(line) > 0 {
+		limit := 75
+		if !first {
+			limit = 74
+		}
+		if limit > len(line) {
+			limit = len(line)
+		}
+		// don't cut a UTF-8 sequence in half
+		for limit < len(line) && limit > 1 && line[limit]&0xC0 == 0x80 {
+			limit--
+		}
+		if !first {
+			b.WriteString(" ")
+		}
+		b.WriteString(line[:limit] + "\r\n")
+		line = line[limit:]
+		first = false
+	}
+	return b.String()
+}
+
+func formatICSTime(name string, t time.Time, allday bool) string {
+	if allday {
+		return fmt.Sprintf("%s;VALUE=DATE:%s", name, t.Format(icsDateString))
+	}
+	return fmt.Sprintf("%s:%s", name, t.UTC().Format(icsUTCTimeString))
+}
+
+// formatTime writes one of e's times the way it was read: in its TZID's
+// local time, floating, or otherwise UTC.
+func (e *icsEvent) formatTime(name string, t time.Time) string {
+	if e.event.AllDay {
+		return formatICSTime(name, t, true)
+	}
+	if e.tzid != "" {
+		if loc, err := time.LoadLocation(e.tzid); err == nil {
+			return fmt.Sprintf("%s;TZID=%s:%s", name, e.tzid, t.In(loc).Format(icsTimeString))
+		}
+	}
+	if e.floating {
+		return fmt.Sprintf("%s:%s", name, t.In(time.Local).Format(icsTimeString))
+	}
+	return formatICSTime(name, t, false)
+}
+
+func (c *icsCalendar) encode() []byte {
+	var b strings.Builder
+	if c.layout != nil {
+		live := make(map[*icsEvent]bool)
+		for _, e := range c.events {
+			live[e] = true
+		}
+		read := make(map[*icsEvent]bool)
+		for _, chunk := range c.layout {
+			read[chunk.event] = true
+		}
+		for i, chunk := range c.layout {
+			if i == c.insertAt {
+				for _, e := range c.events {
+					if !read[e] {
+						b.WriteString(e.encode())
+					}
+				}
+			}
+			if chunk.event == nil {
+				b.WriteString(chunk.text)
+			} else if live[chunk.event] {
+				b.WriteString(chunk.event.encode())
+			}
+		}
+		return []byte(b.String())
+	}
+
+	b.WriteString("BEGIN:VCALENDAR\r\n")
+	header := c.header
+	if len(header) == 0 {
+		header = []string{"VERSION:2.0", "PRODID:-//uffish//rotator//EN"}
+	}
+	for _, line := range header {
+		b.WriteString(foldICS(line))
+	}
+	for _, line := range c.other {
+		b.WriteString(foldICS(line))
+	}
+	for _, e := range c.events {
+		b.WriteString(e.encode())
+	}
+	b.WriteString("END:VCALENDAR\r\n")
+	return []byte(b.String())
+}
+
+// encode writes a VEVENT: as it was read if we haven't changed it.
+func (e *icsEvent) encode() string {
+	if e.raw != "" && !e.changed() {
+		return e.raw
+	}
+	var b strings.Builder
+	b.WriteString("BEGIN:VEVENT\r\n")
+	b.WriteString(foldICS("UID:" + e.UID))
+	hasStamp := false
+	for _, line := range e.extra {
+		if strings.HasPrefix(strings.ToUpper(line), "DTSTAMP") {
+			hasStamp = true
+		}
+	}
+	if !hasStamp {
+		// (kept, so the event reads the same next time it's written)
+		e.extra = append([]string{"DTSTAMP:" + time.Now().UTC().Format(icsUTCTimeString)}, e.extra...)
+	}
+	b.WriteString(foldICS("SUMMARY:" + escapeICS(e.event.Summary)))
+	b.WriteString(foldICS(e.formatTime("DTSTART", e.event.Start)))
+	b.WriteString(foldICS(e.formatTime("DTEND", e.event.End)))
+	for _, a := range e.event.Attendees {
+		if line, ok := e.attendees[strings.ToLower(a)]; ok {
+			b.WriteString(foldICS(line))
+		} else {
+			b.WriteString(foldICS("ATTENDEE:mailto:" + a))
+		}
+	}
+	for _, line := range e.extra {
+		b.WriteString(foldICS(line))
+	}
+	b.WriteString("END:VEVENT\r\n")
+	return b.String()
+}
+
+func (e *icsEvent) changed() bool {
+	if !sameEvent(e.orig, e.event) || len(e.extra) != len(e.origExtra) {
+		return true
+	}
+	for i := range e.extra {
+		if e.extra[i] != e.origExtra[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// recurrenceKey identifies an instance of a recurring event by its start
+// (in UTC, or as a date for all-day events), however its RECURRENCE-ID
+// was written.
+func recurrenceKey(t time.Time, allday bool) string {
+	if allday {
+		return t.Format(icsDateString)
+	}
+	return t.UTC().Format(icsUTCTimeString)
+}
+
+// recurrenceLine is a property (RECURRENCE-ID or EXDATE) naming the
+// instance key.
+func recurrenceLine(name string, key string) string {
+	if len(key) == len(icsDateString) {
+		return name + ";VALUE=DATE:" + key
+	}
+	return name + ":" + key
+}
+
+// instance finds the event for an instance key ("" for the event itself).
+func (c *icsCalendar) instance(key string) *icsEvent {
+	for _, e := range c.events {
+		if e.Recurrence == key {
+			return e
+		}
+	}
+	return nil
+}
+
+// overlaps reports whether an event falls (partly) within [start, end).
+func (e *calendarEvent) overlaps(start time.Time, end time.Time) bool {
+	return e.Start.Before(end) && e.End.After(start)
+}
+
+func newUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b) + "@rotator"
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// icsFileBackend keeps calendars in local iCalendar files. A calendar ID
+// is either a single .ics file or a directory of them; in the latter case
+// new events get a file of their own. Files are loaded once and kept in
+// memory, so with -dry_run later reads still see earlier (unwritten)
+// changes, and each change is printed as a diff instead. Event IDs are
+// UIDs; events without one get an ID made from their text, and are left
+// alone.
+type icsFileBackend struct {
+	calendars map[string][]*icsFile
+}
+
+type icsFile struct {
+	path string
+	raw  []byte
+	cal  *icsCalendar
+}
+
+func initICSFile() (*icsFileBackend, error) {
+	return &icsFileBackend{calendars: make(map[string][]*icsFile)}, nil
+}
+
+func loadICSFile(path string) (*icsFile, error) {
+	f := &icsFile{path: path, cal: &icsCalendar{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		// will be created on first write
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.raw = data
+	f.cal, err = parseICS(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return f, nil
+}
+
+func (b *icsFileBackend) load(calendarID string) ([]*icsFile, error) {
+	if files, ok := b.calendars[calendarID]; ok {
+		return files, nil
+	}
+	paths := []string{calendarID}
+	if st, err := os.Stat(calendarID); err == nil && st.IsDir() {
+		paths, err = filepath.Glob(filepath.Join(calendarID, "*.ics"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	files := []*icsFile{}
+	for _, p := range paths {
+		f, err := loadICSFile(p)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	b.calendars[calendarID] = files
+	return files, nil
+}
+
+func (b *icsFileBackend) find(calendarID string, id string) (*icsFile, int, error) {
+	files, err := b.load(calendarID)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, f := range files {
+		for i, e := range f.cal.events {
+			if icsEventID(e) != id {
+				continue
+			}
+			if e.UID == "" {
+				return nil, 0, fmt.Errorf("event %q in %s has no UID, not changing it", e.event.Summary, f.path)
+			}
+			return f, i, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("no event %s in %s", id, calendarID)
+}
+
+func icsEventID(e *icsEvent) string {
+	if e.UID != "" {
+		return e.UID
+	}
+	sum := sha256.Sum256([]byte(e.raw))
+	return "nouid-" + hex.EncodeToString(sum[:8])
+}
+
+func (b *icsFileBackend) ListEvents(calendarID string, start time.Time, end time.Time) ([]*calendarEvent, error) {
+	files, err := b.load(calendarID)
+	if err != nil {
+		return nil, err
+	}
+	result := []*calendarEvent{}
+	for _, f := range files {
+		for _, e := range f.cal.events {
+			if !e.event.overlaps(start, end) {
+				continue
+			}
+			// hand out copies, callers modify them before UpdateEvent
+			event := *e.event
+			event.ID = icsEventID(e)
+			result = append(result, &event)
+		}
+	}
+	return result, nil
+}
+
+func (b *icsFileBackend) InsertEvent(calendarID string, event *calendarEvent) error {
+	files, err := b.load(calendarID)
+	if err != nil {
+		return err
+	}
+	uid := newUID()
+	var target *icsFile
+	if st, err := os.Stat(calendarID); err == nil && st.IsDir() {
+		target = &icsFile{
+			path: filepath.Join(calendarID, strings.TrimSuffix(uid, "@rotator")+".ics"),
+			cal:  &icsCalendar{},
+		}
+		b.calendars[calendarID] = append(files, target)
+	} else {
+		target = files[0]
+	}
+	stored := *event
+	target.cal.events = append(target.cal.events, &icsEvent{UID: uid, event: &stored})
+	event.ID = uid
+	return target.write()
+}
+
+func (b *icsFileBackend) UpdateEvent(calendarID string, event *calendarEvent) error {
+	f, i, err := b.find(calendarID, event.ID)
+	if err != nil {
+		return err
+	}
+	stored := *event
+	f.cal.events[i].event = &stored
+	return f.write()
+}
+
+func (b *icsFileBackend) DeleteEvent(calendarID string, eventID string) error {
+	f, i, err := b.find(calendarID, eventID)
+	if err != nil {
+		return err
+	}
+	f.cal.events = append(f.cal.events[:i], f.cal.events[i+1:]...)
+	return f.write()
+}
+
+// write replaces the file atomically (write to a temp file, then rename),
+// or just prints what would change if this is a dry run.
+func (f *icsFile) write() error {
+	data := f.cal.encode()
+	if *flagDryRun {
+		fmt.Print(unifiedDiff(f.path, string(f.raw), string(data)))
+		f.raw = data
+		return nil
+	}
+	if err := writeFileAtomic(f.path, data); err != nil {
+		return err
+	}
+	f.raw = data
+	return nil
+}
+
+// unifiedDiff produces a minimal unified diff (3 lines of context)
+// between two versions of a text file.
+func unifiedDiff(name string, before string, after string) string {
+	split := func(s string) []string {
+		s = strings.Replace(s, "\r\n", "\n", -1)
+		if s == "" {
+			return []string{}
+		}
+		return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	}
+	a, b := split(before), split(after)
+
+	// Strip common prefix and suffix; rota changes are small and local,
+	// which keeps the LCS table tiny even for large files.
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	ma, mb := a[pre:len(a)-suf], b[pre:len(b)-suf]
+	if len(ma) == 0 && len(mb) == 0 {
+		return ""
+	}
+
+	lcs := make([][]int, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	body := []string{}
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			body = append(body, " "+ma[i])
+			i++
+			j++
+		case i < len(ma) && (j == len(mb) || lcs[i+1][j] >= lcs[i][j+1]):
+			body = append(body, "-"+ma[i])
+			i++
+		default:
+			body = append(body, "+"+mb[j])
+			j++
+		}
+	}
+
+	ctx := 3
+	if pre < ctx {
+		ctx = pre
+	}
+	head := a[pre-ctx : pre]
+	tailLen := 3
+	if suf < tailLen {
+		tailLen = suf
+	}
+	tail := a[len(a)-suf : len(a)-suf+tailLen]
+
+	out := []string{fmt.Sprintf("--- %s", name), fmt.Sprintf("+++ %s (new)", name),
+		fmt.Sprintf("@@ -%d,%d +%d,%d @@", pre-ctx+1, ctx+len(ma)+tailLen,
+			pre-ctx+1, ctx+len(mb)+tailLen)}
+	for _, l := range head {
+		out = append(out, " "+l)
+	}
+	out = append(out, body...)
+	for _, l := range tail {
+		out = append(out, " "+l)
+	}
+	return strings.Join(out, "\n") + "\n"
+}
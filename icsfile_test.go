@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A file as some other program wrote it: LF line endings, a folded line,
+// a recurring event in local time with an exception, and two events
+// without a UID.
+const icsForeign = "BEGIN:VCALENDAR\n" +
+	"VERSION:2.0\n" +
+	"PRODID:-//Other//EN\n" +
+	"BEGIN:VEVENT\n" +
+	"UID:standup\n" +
+	"SUMMARY:standup\n" +
+	"DTSTART;TZID=Europe/Vienna:20260302T093000\n" +
+	"DTEND;TZID=Europe/Vienna:20260302T094500\n" +
+	"RRULE:FREQ=WEEKLY\n" +
+	"EXDATE;TZID=Europe/Vienna:20260309T093000\n" +
+	"DESCRIPTION:a long description that someone's calendar program has folded\n" +
+	"  onto two lines\n" +
+	"END:VEVENT\n" +
+	"BEGIN:VEVENT\n" +
+	"UID:onduty-1\n" +
+	"SUMMARY:aa onduty\n" +
+	"DTSTART;TZID=Europe/Vienna:20260303T080000\n" +
+	"DTEND;TZID=Europe/Vienna:20260304T080000\n" +
+	"END:VEVENT\n" +
+	"BEGIN:VEVENT\n" +
+	"SUMMARY:bob away\n" +
+	"DTSTART;VALUE=DATE:20260305\n" +
+	"END:VEVENT\n" +
+	"BEGIN:VEVENT\n" +
+	"SUMMARY:fb away\n" +
+	"DTSTART;VALUE=DATE:20260306\n" +
+	"END:VEVENT\n" +
+	"END:VCALENDAR\n"
+
+func TestICSFileKeepsWhatItDoesntChange(t *testing.T) {
+	setupTest(t, "Europe/Vienna")
+	dir, err := ioutil.TempDir("", "rotator-ics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "oncall.ics")
+	if err := ioutil.WriteFile(path, []byte(icsForeign), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := initICSFile()
+
+	start, _ := parseDate("2026-03-01")
+	events, err := b.ListEvents(path, start, start.AddDate(0, 0, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	byID := make(map[string]*calendarEvent)
+	for _, e := range events {
+		byID[e.ID] = e
+	}
+	if len(byID) != 4 {
+		t.Fatalf("want 4 distinct IDs, got %d", len(byID))
+	}
+
+	// Changing one event leaves the rest of the file as it was.
+	e := byID["onduty-1"]
+	e.Summary = "bob onduty"
+	if err := b.UpdateEvent(path, e); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	got := string(data)
+	untouched := icsForeign[:strings.Index(icsForeign, "BEGIN:VEVENT\nUID:onduty-1")]
+	if !strings.HasPrefix(got, untouched) {
+		t.Errorf("recurring event rewritten:\n%s", got)
+	}
+	if !strings.HasSuffix(got, icsForeign[strings.Index(icsForeign, "BEGIN:VEVENT\nSUMMARY:bob away"):]) {
+		t.Errorf("events without UID rewritten:\n%s", got)
+	}
+	// and the changed one keeps its local times
+	for _, want := range []string{"SUMMARY:bob onduty\r\n",
+		"DTSTART;TZID=Europe/Vienna:20260303T080000\r\n", "DTEND;TZID=Europe/Vienna:20260304T080000\r\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+
+	// Adding one puts it in before the end.
+	added := &calendarEvent{Summary: "fb onduty", AllDay: true,
+		Start: time.Date(2026, 3, 7, 0, 0, 0, 0, time.UTC), End: time.Date(2026, 3, 8, 0, 0, 0, 0, time.UTC)}
+	if err := b.InsertEvent(path, added); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadFile(path)
+	got = string(data)
+	if !strings.HasPrefix(got, untouched) || !strings.HasSuffix(got, "END:VEVENT\r\nEND:VCALENDAR\n") ||
+		!strings.Contains(got, "SUMMARY:fb onduty") {
+		t.Errorf("bad insert:\n%s", got)
+	}
+
+	// Events without a UID can't be told apart reliably, so they're
+	// left alone.
+	for id, e := range byID {
+		if !strings.HasPrefix(id, "nouid-") {
+			continue
+		}
+		e.Summary = "xx onduty"
+		if err := b.UpdateEvent(path, e); err == nil {
+			t.Errorf("updated event without UID %q", id)
+		}
+		if err := b.DeleteEvent(path, id); err == nil {
+			t.Errorf("deleted event without UID %q", id)
+		}
+	}
+}
+
+func TestICSFileDryRunDiff(t *testing.T) {
+	setupTest(t, "Europe/Vienna")
+	dir, err := ioutil.TempDir("", "rotator-ics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "oncall.ics")
+	ioutil.WriteFile(path, []byte(icsForeign), 0644)
+	*flagDryRun = true
+	defer func() { *flagDryRun = false }()
+
+	b, _ := initICSFile()
+	f, _, err := b.find(path, "onduty-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.cal.events[1].event.Summary = "bob onduty"
+	diff := unifiedDiff(path, string(f.raw), string(f.cal.encode()))
+	var changed []string
+	for _, line := range strings.Split(diff, "\n") {
+		if strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-") {
+			changed = append(changed, line)
+		}
+	}
+	// the ---/+++ header, and the event itself
+	if len(changed) > 2+2*5+1 {
+		t.Errorf("diff touches more than the event:\n%s", diff)
+	}
+	for _, line := range changed[2:] {
+		if strings.Contains(line, "standup") || strings.Contains(line, "away") {
+			t.Errorf("diff touches other events:\n%s", diff)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The journal (in JournalDir) records every change a run makes to the
+// oncall calendar and OpsGenie, together with what was there before, in
+// a JSON lines file named after the run ID. "rotator rollback RUNID" uses
+// it to undo the run: events it changed or deleted are put back as they
+// were, events it inserted are removed, and overrides are restored (or
+// removed if the run created them).
+type journalEntry struct {
+	Time     time.Time      `json:"time"`
+	Run      string         `json:"run"`
+	Rotation string         `json:"rotation,omitempty"`
+	Kind     string         `json:"kind"` // "insert", "update", "delete" or "opsgenie"
+	Calendar string         `json:"calendar,omitempty"`
+	Event    *calendarEvent `json:"event,omitempty"`
+	Before   *calendarEvent `json:"before,omitempty"`
+	Alias    string         `json:"alias,omitempty"`
+	Previous *ogOverride    `json:"previous,omitempty"`
+}
+
+// runID identifies this run in the journal and the audit log.
+var runID = newRunID()
+
+// The number of changes journaled in this run.
+var journaled int
+
+func newRunID() string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(b)
+}
+
+func journalFile(run string) string {
+	return filepath.Join(config.JournalDir, run+".jsonl")
+}
+
+// appendJournal adds entry to this run's journal. Nothing is journaled on
+// a dry run or while making a plan (applying it is a run of its own).
+func appendJournal(entry journalEntry) {
+	if config.JournalDir == "" || *flagDryRun || activePlan != nil {
+		return
+	}
+	entry.Time = time.Now()
+	entry.Run = runID
+	entry.Rotation = activeRotation
+	data, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Printf("Error writing journal: %s\n", err)
+		return
+	}
+	if err := os.MkdirAll(config.JournalDir, 0755); err != nil {
+		fmt.Printf("Error writing journal: %s\n", err)
+		return
+	}
+	f, err := os.OpenFile(journalFile(runID), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		fmt.Printf("Error writing journal: %s\n", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		fmt.Printf("Error writing journal: %s\n", err)
+		return
+	}
+	journaled++
+}
+
+// journalOverride records a change to an OpsGenie override; previous is
+// what it was before, if it existed.
+func journalOverride(alias string, previous *ogOverride) {
+	appendJournal(journalEntry{Kind: "opsgenie", Alias: alias, Previous: previous})
+}
+
+// journalBackend passes everything through to the real calendar, and
+// journals the writes. The previous body of an event comes from the last
+// time it was read, which rotator always does before changing anything.
+type journalBackend struct {
+	cal  CalendarBackend
+	seen map[string]*calendarEvent
+}
+
+func newJournalBackend(cal CalendarBackend) *journalBackend {
+	return &journalBackend{cal: cal, seen: make(map[string]*calendarEvent)}
+}
+
+func (j *journalBackend) ListEvents(calendarID string, start time.Time, end time.Time) ([]*calendarEvent, error) {
+	events, err := j.cal.ListEvents(calendarID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range events {
+		j.seen[calendarID+"|"+e.ID] = copyEvent(e)
+	}
+	return events, nil
+}
+
+func (j *journalBackend) LoadRange(calendarID string, start time.Time, end time.Time) error {
+	return loadRange(j.cal, calendarID, start, end)
+}
+
+func (j *journalBackend) InsertEvent(calendarID string, event *calendarEvent) error {
+	if err := j.cal.InsertEvent(calendarID, event); err != nil {
+		return err
+	}
+	j.seen[calendarID+"|"+event.ID] = copyEvent(event)
+	appendJournal(journalEntry{Kind: "insert", Calendar: calendarID, Event: copyEvent(event)})
+	return nil
+}
+
+func (j *journalBackend) UpdateEvent(calendarID string, event *calendarEvent) error {
+	key := calendarID + "|" + event.ID
+	before := j.seen[key]
+	if err := j.cal.UpdateEvent(calendarID, event); err != nil {
+		return err
+	}
+	j.seen[key] = copyEvent(event)
+	appendJournal(journalEntry{Kind: "update", Calendar: calendarID, Event: copyEvent(event), Before: before})
+	return nil
+}
+
+func (j *journalBackend) DeleteEvent(calendarID string, eventID string) error {
+	key := calendarID + "|" + eventID
+	before := j.seen[key]
+	if err := j.cal.DeleteEvent(calendarID, eventID); err != nil {
+		return err
+	}
+	delete(j.seen, key)
+	appendJournal(journalEntry{Kind: "delete", Calendar: calendarID,
+		Event: &calendarEvent{ID: eventID}, Before: before})
+	return nil
+}
+
+// journalSummary tells the user how to undo this run, if it changed
+// anything.
+func journalSummary() {
+	if journaled > 0 {
+		fmt.Printf("%d changes journaled as run %s (undo with: rotator rollback %s)\n",
+			journaled, runID, runID)
+	}
+}
+
+func readJournal(run string) ([]journalEntry, error) {
+	f, err := os.Open(journalFile(run))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []journalEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s: %s", journalFile(run), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// listRuns prints the journaled runs, most recent last.
+func listRuns() error {
+	files, err := ioutil.ReadDir(config.JournalDir)
+	if err != nil {
+		return err
+	}
+	var runs []string
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".jsonl") {
+			runs = append(runs, strings.TrimSuffix(f.Name(), ".jsonl"))
+		}
+	}
+	sort.Strings(runs)
+	for _, run := range runs {
+		entries, err := readJournal(run)
+		if err != nil {
+			fmt.Printf("%s: %s\n", run, err)
+			continue
+		}
+		fmt.Printf("%s: %d changes\n", run, len(entries))
+	}
+	return nil
+}
+
+// rollbackCommand handles "rollback [RUNID]", undoing the changes of the
+// given run in reverse order, or listing the runs there are.
+func rollbackCommand(cal CalendarBackend, args []string) error {
+	if config.JournalDir == "" {
+		return errors.New("no journaldir configured")
+	}
+	if len(args) == 0 {
+		return listRuns()
+	}
+	if len(args) != 1 {
+		return errors.New("usage: rollback [RUNID]")
+	}
+	run := args[0]
+	entries, err := readJournal(run)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	rotation := ""
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if i == len(entries)-1 || e.Rotation != rotation {
+			if err := switchRotation(e.Rotation); err != nil {
+				return err
+			}
+			rotation = e.Rotation
+		}
+		if err := undoEntry(cal, e); err != nil {
+			fmt.Printf("Unable to undo %s: %s\n", describeJournal(e), err)
+			failed++
+			continue
+		}
+		if *flagVerbose {
+			fmt.Printf("Undid %s\n", describeJournal(e))
+		}
+		auditUndo(e, run)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d changes of run %s could not be undone", failed, len(entries), run)
+	}
+	fmt.Printf("Rolled back %d changes of run %s\n", len(entries), run)
+	return nil
+}
+
+// switchRotation makes the named rotation the active one.
+func switchRotation(name string) error {
+	rotations := selectRotations(name)
+	if len(rotations) != 1 {
+		return fmt.Errorf("no rotation called %q", name)
+	}
+	useRotation(rotations[0])
+	return nil
+}
+
+func undoEntry(cal CalendarBackend, e journalEntry) error {
+	switch e.Kind {
+	case "insert":
+		return cal.DeleteEvent(e.Calendar, e.Event.ID)
+	case "update":
+		if e.Before == nil {
+			return errors.New("previous event not journaled")
+		}
+		return cal.UpdateEvent(e.Calendar, e.Before)
+	case "delete":
+		if e.Before == nil {
+			return errors.New("deleted event not journaled")
+		}
+		return cal.InsertEvent(e.Calendar, copyEvent(e.Before))
+	case "opsgenie":
+		if config.OpsGenie.APIKey == "" || *flagDryRun {
+			return nil
+		}
+		if e.Previous != nil {
+			return ogRestoreOverride(*e.Previous)
+		}
+		return ogDeleteOverride(e.Alias)
+	}
+	return fmt.Errorf("unknown kind of change %q", e.Kind)
+}
+
+func describeJournal(e journalEntry) string {
+	switch e.Kind {
+	case "insert":
+		return "insert of " + describeEvent(e.Event)
+	case "update":
+		return "update of " + describeEvent(e.Before) + " to " + describeEvent(e.Event)
+	case "delete":
+		return "delete of " + describeEvent(e.Before)
+	}
+	return e.Kind + " " + e.Alias
+}
+
+// auditUndo logs an undone change in the audit log.
+func auditUndo(e journalEntry, run string) {
+	entry := auditEntry{Target: "calendar", Role: "rollback", Reason: "rollback " + run}
+	switch e.Kind {
+	case "insert":
+		entry.Day = eventDay(e.Event)
+		entry.Old = e.Event.Summary
+	case "update":
+		entry.Day = eventDay(e.Before)
+		entry.Old = e.Event.Summary
+		entry.New = e.Before.Summary
+	case "delete":
+		entry.Day = eventDay(e.Before)
+		entry.New = e.Before.Summary
+	case "opsgenie":
+		entry.Target = "opsgenie"
+		entry.Alias = e.Alias
+		if e.Previous != nil {
+			entry.New = e.Previous.User.Username
+		}
+	}
+	writeAudit(entry)
+}
+
+func eventDay(e *calendarEvent) string {
+	if e.AllDay {
+		return dateFormat(e.Start)
+	}
+	return dateFormat(e.Start.In(rotaLocation))
+}
@@ -8,11 +8,7 @@ import (
 )
 
 // Write a Prometheus-scrapeable file that tells us who's oncall.
-func writeMonitoringFile(oncaller string,
-	order []oncallPerson, dest string) error {
-	hn, _ := os.Hostname()
-	hn = strings.Split(hn, ".")[0]
-	sn := path.Base(os.Args[0])
+func writeMonitoringFile(status []string, dest string) error {
 	// create or truncate the output file
 	fd, err := os.Create(dest)
 	if err != nil {
@@ -25,15 +21,43 @@ func writeMonitoringFile(oncaller string,
 	// print preamble
 	output = append(output, fmt.Sprintf("# HELP oncall_rotation_status Positive if oncall."))
 	output = append(output, fmt.Sprintf("# TYPE oncall_rotation_status gauge"))
+	output = append(output, status...)
+	_, err = fd.WriteString(strings.Join(output, "\n") + "\n")
+	return err
+}
+
+// monitoringStatus returns the status lines for one rotation. The role
+// label is "primary", or "secondary" for the backup oncaller; a rotation
+// label is only added for named rotations.
+func monitoringStatus(rotation string, oncaller string, backup string,
+	order []oncallPerson) []string {
+	hn, _ := os.Hostname()
+	hn = strings.Split(hn, ".")[0]
+	sn := path.Base(os.Args[0])
+	labels := ""
+	if rotation != "" {
+		labels = fmt.Sprintf(",rotation=\"%s\"", rotation)
+	}
+	output := []string{}
 	for _, person := range order {
 		status := 0
 		if oncaller == person.Code {
 			status = 1
 		}
 		output = append(output, fmt.Sprintf(
-			"oncall_rotation_status{scripthost=\"%s\",oncaller=\"%s\",scriptname=\"%s\"} %d",
-			hn, person.Code, sn, status))
+			"oncall_rotation_status{scripthost=\"%s\",oncaller=\"%s\",scriptname=\"%s\",role=\"primary\"%s} %d",
+			hn, person.Code, sn, labels, status))
 	}
-	_, err = fd.WriteString(strings.Join(output, "\n") + "\n")
-	return err
+	if config.BackupOncall {
+		for _, person := range order {
+			status := 0
+			if backup == person.Code {
+				status = 1
+			}
+			output = append(output, fmt.Sprintf(
+				"oncall_rotation_status{scripthost=\"%s\",oncaller=\"%s\",scriptname=\"%s\",role=\"secondary\"%s} %d",
+				hn, person.Code, sn, labels, status))
+		}
+	}
+	return output
 }
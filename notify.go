@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"net/smtp"
 	"os"
-	"os/user"
 	"strings"
 	"time"
 )
@@ -23,7 +22,7 @@ func doNotify(victim oncallPerson, when string) error {
 	var mail message
 	emergency := false
 
-	d := time.Now()
+	d := rotaNow()
 	if when == "tomorrow" {
 		d = d.AddDate(0, 0, 1)
 	}
@@ -76,12 +75,44 @@ func doNotify(victim oncallPerson, when string) error {
 	return err
 }
 
+// Tell someone about a swap: they gave up one day to other and took
+// another of theirs in return.
+func doSwapNotify(victim oncallPerson, other oncallPerson, gave time.Time, took time.Time) error {
+	var mail message
+
+	if victim.Email == "" {
+		// nobody to send it to
+		return nil
+	}
+	mail.Destination = victim.Email
+	mail.Sender = config.MailSender
+	mail.Subject = fmt.Sprintf("Oncall swap: you are on duty %s instead of %s",
+		took.Format("Mon 2 Jan"), gave.Format("Mon 2 Jan"))
+	mail.Body = []string{fmt.Sprintf("Dear %s,", victim.Code),
+		fmt.Sprintf("%s is now on duty on %s in your place, and you are on duty",
+			other.Code, gave.Format("Mon 2 Jan")),
+		fmt.Sprintf("on %s instead of them.", took.Format("Mon 2 Jan")),
+		"",
+		" - the VSI onduty rotator",
+	}
+	if config.MailServer == "" {
+		config.MailServer = "localhost:25"
+	}
+	return mailSend(mail, config.MailServer)
+}
+
 func mailSend(mail message, server string) error {
+	if activePlan != nil {
+		planNotification(&planOp{Kind: "mail", Mail: &mail})
+		return nil
+	}
 
 	if mail.Sender == "" {
-		u, _ := user.Current()
-		hn, _ := os.Hostname()
-		mail.Sender = fmt.Sprintf("%s@%s", u.Username, hn)
+		hn, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("no mailsender configured, and %s", err)
+		}
+		mail.Sender = fmt.Sprintf("%s@%s", invokingUser(), hn)
 	}
 
 	headers := []string{fmt.Sprintf("To: %s", mail.Destination),
@@ -4,8 +4,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
-	"net/url"
 	"time"
 )
 
@@ -17,10 +17,12 @@ var ogScheduleCommand = string("timeline")
 var ogURLPrefix = string("https://api.opsgenie.com/v2/schedules")
 
 type ogConfig struct {
-	APIKey          string
-	ScheduleID      string
-	WeekdaySchedule string
-	WeekendSchedule string
+	APIKey                string
+	ScheduleID            string
+	WeekdaySchedule       string
+	WeekendSchedule       string
+	BackupWeekdaySchedule string
+	BackupWeekendSchedule string
 }
 
 type ogUser struct {
@@ -43,6 +45,12 @@ type ogOverrideResponse struct {
 	RequestID string
 }
 
+type ogSingleOverrideResponse struct {
+	Data      ogOverride
+	Took      int
+	RequestID string
+}
+
 type ogOncallData struct {
 	OncallRecipients []string
 }
@@ -59,120 +67,230 @@ type ogRotation struct {
 	Name string `json:"name"`
 }
 
-func setOpsgenieByDay(day time.Time, email string) bool {
-	schedule := config.OpsGenie.WeekdaySchedule
-	starttime := time.Date(day.Year(), day.Month(), day.Day(), 8, 0, 0, 0, time.Local)
+// setOpsgenieByDay gives day's override to email; reason (see
+// changeReason) goes in the audit log.
+func setOpsgenieByDay(day time.Time, email string, reason string) error {
+	return ogSetOverride(day, "onduty", day.Format(ogDateAliasString),
+		config.OpsGenie.WeekdaySchedule, config.OpsGenie.WeekendSchedule, email, reason)
+}
+
+// Backups go to their own rotations, with their own override aliases.
+func setOpsgenieBackupByDay(day time.Time, email string, reason string) error {
+	if config.OpsGenie.BackupWeekdaySchedule == "" && config.OpsGenie.BackupWeekendSchedule == "" {
+		return nil
+	}
+	return ogSetOverride(day, "backup", day.Format(ogDateAliasString)+"-backup",
+		config.OpsGenie.BackupWeekdaySchedule, config.OpsGenie.BackupWeekendSchedule, email, reason)
+}
+
+func ogSetOverride(day time.Time, role string, alias string, weekdaySchedule string,
+	weekendSchedule string, email string, reason string) error {
+	schedule := weekdaySchedule
+	if isWeekend(day) {
+		schedule = weekendSchedule
+	}
+
+	// Overrides run from the handover until midnight, or with a fixed
+	// handover time from one handover to the next, in the rota's time zone.
+	starttime := atClock(day, handoverClock(day))
+	endtime := dayStart(day.AddDate(0, 0, 1))
+	if config.HandoverTime != "" {
+		endtime = atClock(day.AddDate(0, 0, 1), config.HandoverTime)
+	}
+	// Follow-the-sun overrides cover exactly the region's shift.
+	if activeRegion != nil {
+		starttime, endtime, _ = roleWindow(day)
+		alias += regionSlug()
+	}
+
+	return ogWriteOverride(day, role, alias, starttime, endtime, schedule, email, reason)
+}
 
-	// figure out whether to use weekend or weekday schedule
-	if day.Weekday() == 6 || day.Weekday() == 0 {
+// Covers get an override of their own for exactly the window covered,
+// on top of the day's.
+func setOpsgenieCover(starttime time.Time, endtime time.Time, email string) error {
+	schedule := config.OpsGenie.WeekdaySchedule
+	if isWeekend(starttime) {
 		schedule = config.OpsGenie.WeekendSchedule
-		starttime = time.Date(day.Year(), day.Month(), day.Day(), 10, 0, 0, 0, time.Local)
 	}
+	alias := starttime.Format(ogDateAliasString) + "-cover-" + starttime.Format("1504")
+	return ogWriteOverride(starttime, "cover", alias, starttime, endtime, schedule, email, "cover")
+}
 
-	if ogCheckForOverride(day) == true {
-		ogUpdateOverride(starttime, schedule, email)
-	} else {
-		ogCreateOverride(starttime, schedule, email)
+// ogWriteOverride creates or updates an override, and logs it in the
+// audit log (with whoever had the override before, and reason) and the
+// run's journal. On a dry run, OpsGenie is left alone, like the calendar.
+func ogWriteOverride(day time.Time, role string, alias string, starttime time.Time,
+	endtime time.Time, schedule string, email string, reason string) error {
+	if activePlan != nil {
+		planNotification(&planOp{Kind: "opsgenie", Override: &planOverride{Day: day, Role: role,
+			Alias: alias, Start: starttime, End: endtime, Schedule: schedule, Email: email,
+			Reason: reason}})
+		return nil
+	}
+	if *flagDryRun {
+		if *flagVerbose {
+			fmt.Printf("Dry run: not setting OpsGenie override %s to %s\n", alias, email)
+		}
+		return nil
+	}
+	previous, err := ogGetOverride(alias)
+	if err == nil {
+		if previous != nil {
+			err = ogUpdateOverride(alias, starttime, endtime, schedule, email)
+		} else {
+			err = ogCreateOverride(alias, starttime, endtime, schedule, email)
+		}
+		if err == nil {
+			journalOverride(alias, previous)
+		}
+	}
+	old := ""
+	if previous != nil {
+		old = previous.User.Username
 	}
-	return false
+	writeAudit(auditEntry{Target: "opsgenie", Role: role, Day: dateFormat(day), Old: old, New: email,
+		Reason: reason, Start: &starttime, End: &endtime, Alias: alias, Failed: err != nil})
+	return err
 }
 
-func ogCheckForOverride(day time.Time) bool {
-	u, _ := url.Parse(ogURLPrefix + "/" +
-		config.OpsGenie.ScheduleID + "/" + ogOverrideCommand + "/" +
-		day.Format(ogDateAliasString))
-	cli := &http.Client{}
-	req, _ := http.NewRequest("GET", u.String(), nil)
+// ogRequest sends a request about the schedule's overrides (path goes
+// after ".../overrides") and returns the response status and body.
+func ogRequest(method string, path string, body []byte) (int, []byte, error) {
+	u := ogURLPrefix + "/" + config.OpsGenie.ScheduleID + "/" + ogOverrideCommand + path
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
 	req.Header.Add("Authorization",
 		fmt.Sprintf("GenieKey %s", config.OpsGenie.APIKey))
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	cli := &http.Client{}
 	resp, err := cli.Do(req)
 	if err != nil {
-		panic(err)
+		return 0, nil, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		return true
+	data, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+// ogError describes a failed request, with OpsGenie's own explanation if
+// it gave one.
+func ogError(action string, alias string, status int, body []byte) error {
+	var result struct {
+		Message string
 	}
-	return false
+	msg := http.StatusText(status)
+	if json.Unmarshal(body, &result) == nil && result.Message != "" {
+		msg = result.Message
+	}
+	return fmt.Errorf("OpsGenie: %s override %s: %d %s", action, alias, status, msg)
+}
+
+func ogCheckForOverride(alias string) (bool, error) {
+	override, err := ogGetOverride(alias)
+	return override != nil, err
 }
 
-func ogCreateOverride(starttime time.Time, schedule string, email string) bool {
+// ogGetOverride fetches an existing override, or returns nil if there
+// isn't one.
+func ogGetOverride(alias string) (*ogOverride, error) {
+	status, body, err := ogRequest("GET", "/"+alias, nil)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	if status != http.StatusOK {
+		return nil, ogError("reading", alias, status, body)
+	}
+	var result ogSingleOverrideResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("OpsGenie: reading override %s: %s", alias, err)
+	}
+	return &result.Data, nil
+}
 
-	enddate := starttime.AddDate(0, 0, 1)
-	endtime := time.Date(enddate.Year(), enddate.Month(), enddate.Day(), 0, 0, 0, 0, time.Local)
+func ogCreateOverride(alias string, starttime time.Time, endtime time.Time, schedule string, email string) error {
 
 	var override ogOverride
-	override.Alias = starttime.Format(ogDateAliasString)
+	override.Alias = alias
 	override.User.Type = "user"
 	override.User.Username = email
 	var rotation ogRotation
 	rotation.Name = schedule
 	override.Rotations = append(override.Rotations, rotation)
-	// var ogTimeString = string("2006-01-02T15:04:05Z")
-	// FIXME(mpk) Requires time zone +01:00
+	// Times carry the rota time zone's UTC offset on the day (DST included).
 	override.StartDate = starttime.Format(ogTimeString)
 	override.EndDate = endtime.Format(ogTimeString)
 	body, _ := json.Marshal(override)
 
-	u, _ := url.Parse(ogURLPrefix + "/" +
-		config.OpsGenie.ScheduleID + "/" + ogOverrideCommand)
-	cli := &http.Client{}
-	req, _ := http.NewRequest("POST", u.String(), bytes.NewBuffer(body))
-	req.Header.Add("Authorization",
-		fmt.Sprintf("GenieKey %s", config.OpsGenie.APIKey))
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := cli.Do(req)
+	status, respBody, err := ogRequest("POST", "", body)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated {
+	if status == http.StatusOK || status == http.StatusCreated {
 		if *flagDebug == true {
 			fmt.Printf("Created %s for %s OK", override.Alias, rotation.Name)
 		}
-		return true
+		return nil
 	}
-	return false
+	return ogError("creating", alias, status, respBody)
 }
 
-func ogUpdateOverride(starttime time.Time, schedule string, email string) bool {
-
-	enddate := starttime.AddDate(0, 0, 1)
-	endtime := time.Date(enddate.Year(), enddate.Month(), enddate.Day(), 0, 0, 0, 0, time.Local)
+func ogUpdateOverride(alias string, starttime time.Time, endtime time.Time, schedule string, email string) error {
 
 	var override ogOverride
-	override.Alias = starttime.Format(ogDateAliasString)
+	override.Alias = alias
 	override.User.Type = "user"
 	override.User.Username = email
 	var rotation ogRotation
 	rotation.Name = schedule
 	override.Rotations = append(override.Rotations, rotation)
-	// var ogTimeString = string("2006-01-02T15:04:05Z")
-	// FIXME(mpk) Requires time zone +01:00
+	// Times carry the rota time zone's UTC offset on the day (DST included).
 	override.StartDate = starttime.Format(ogTimeString)
 	override.EndDate = endtime.Format(ogTimeString)
 	body, _ := json.Marshal(override)
 
-	u, _ := url.Parse(ogURLPrefix + "/" +
-		config.OpsGenie.ScheduleID + "/" + ogOverrideCommand + "/" +
-		starttime.Format(ogDateAliasString))
-	cli := &http.Client{}
-	req, _ := http.NewRequest("PUT", u.String(), bytes.NewBuffer(body))
-	req.Header.Add("Authorization",
-		fmt.Sprintf("GenieKey %s", config.OpsGenie.APIKey))
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := cli.Do(req)
+	status, respBody, err := ogRequest("PUT", "/"+alias, body)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated {
+	if status == http.StatusOK || status == http.StatusCreated {
 		if *flagDebug == true {
 			fmt.Printf("Updated %s for %s OK", override.Alias, rotation.Name)
 		}
-		return true
+		return nil
+	}
+	return ogError("updating", alias, status, respBody)
+}
+
+// ogRestoreOverride puts back an override as it was fetched earlier.
+func ogRestoreOverride(override ogOverride) error {
+	body, _ := json.Marshal(override)
+	status, respBody, err := ogRequest("PUT", "/"+override.Alias, body)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && status != http.StatusCreated {
+		return ogError("restoring", override.Alias, status, respBody)
+	}
+	return nil
+}
+
+func ogDeleteOverride(alias string) error {
+	status, respBody, err := ogRequest("DELETE", "/"+alias, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && status != http.StatusNotFound {
+		return ogError("deleting", alias, status, respBody)
 	}
-	return false
+	return nil
 }
 
 // func getOGURL(command string, args map[string]string) ([]byte, error) {
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// personWeight is someone's share of a full-time load (1 unless set).
+func personWeight(person oncallPerson) float64 {
+	if person.Weight <= 0 {
+		return 1
+	}
+	return person.Weight
+}
+
+// personLimit scales a monthly limit by someone's weight.
+func personLimit(limit int, person oncallPerson) int {
+	return int(math.Ceil(float64(limit) * personWeight(person)))
+}
+
+func hasWeekday(names []string, day time.Time) bool {
+	for _, name := range names {
+		if wd, ok := parseWeekday(name); ok && wd == day.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// wasOncall reports whether code is the (known) oncaller on day.
+func wasOncall(code string, day time.Time) bool {
+	d, ok := oncall.Days[dateFormat(day)]
+	return ok && d != nil && d.Victim.Code == code
+}
+
+// personalBlock returns why person can't be oncall on day according to
+// their own settings, or "" if nothing stands in the way.
+func personalBlock(person oncallPerson, day time.Time) string {
+	if hasWeekday(person.NeverWeekdays, day) {
+		return "never-" + strings.ToLower(day.Weekday().String()[:3])
+	}
+	if isRegionalHoliday(person, day) {
+		return "holiday-" + strings.ToLower(person.HolidayRegion)
+	}
+	if person.MaxConsecutiveDays > 0 {
+		run := 0
+		for run < person.MaxConsecutiveDays && wasOncall(person.Code, day.AddDate(0, 0, -run-1)) {
+			run++
+		}
+		if run >= person.MaxConsecutiveDays {
+			return "consecutive"
+		}
+	}
+	// Carrying on from yesterday isn't a new shift, so needs no rest.
+	if person.MinRestDays > 0 && !wasOncall(person.Code, day.AddDate(0, 0, -1)) {
+		for x := 2; x <= person.MinRestDays+1; x++ {
+			if wasOncall(person.Code, day.AddDate(0, 0, -x)) {
+				return "rest"
+			}
+		}
+	}
+	return ""
+}
+
+// personalBlocks maps the code of everyone blocked by their own settings
+// on day to the reason.
+func personalBlocks(day time.Time) map[string]string {
+	blocks := make(map[string]string)
+	for _, person := range config.Oncallers {
+		if reason := personalBlock(person, day); reason != "" {
+			blocks[person.Code] = reason
+		}
+	}
+	return blocks
+}
+
+// describeBlocks formats personalBlocks for -v output.
+func describeBlocks(day time.Time) string {
+	blocks := personalBlocks(day)
+	if len(blocks) == 0 {
+		return ""
+	}
+	list := []string{}
+	for code, reason := range blocks {
+		list = append(list, fmt.Sprintf("%s(%s)", code, reason))
+	}
+	sort.Strings(list)
+	return ",Blocked: " + strings.Join(list, ",")
+}
+
+// preferredOncall returns the first available person after lastOncall in
+// the rotation who prefers to work on day, if the person whose turn it is
+// doesn't.
+func preferredOncall(unavailable []string, lastOncall oncallPerson,
+	next oncallPerson, day time.Time) (oncallPerson, bool) {
+	if hasWeekday(next.PreferredWeekdays, day) {
+		return next, false
+	}
+	for _, code := range rotationOrderAfter(lastOncall.Code) {
+		person := oncallersByCode[code]
+		if isListed(code, unavailable) {
+			continue
+		}
+		if hasWeekday(person.PreferredWeekdays, day) {
+			return person, true
+		}
+	}
+	return next, false
+}
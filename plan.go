@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// "rotator plan" works out everything a run would do (calendar events to
+// insert, update or delete, OpsGenie overrides, mail and Slack messages)
+// without doing any of it, and saves that to a plan file. "rotator apply"
+// then carries out exactly that plan. The plan also remembers a checksum
+// of every calendar query it was based on, and apply refuses to go ahead
+// if any of them comes back different.
+type rotaPlan struct {
+	Created time.Time  `json:"created"`
+	Args    []string   `json:"args"`
+	Reads   []planRead `json:"reads"`
+	Ops     []*planOp  `json:"ops"`
+}
+
+type planRead struct {
+	Calendar string    `json:"calendar"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Hash     string    `json:"hash"`
+}
+
+// planOp is one change. Kind is "insert", "update" or "delete" (calendar
+// events), "opsgenie", "mail", "slack" or "slack-dm". Rotation is the
+// rotation it belongs to, whose settings (API keys etc.) apply. Audit holds
+// the audit log entries for the change it completes, logged once it's done.
+type planOp struct {
+	Kind        string         `json:"kind"`
+	Rotation    string         `json:"rotation,omitempty"`
+	Calendar    string         `json:"calendar,omitempty"`
+	Event       *calendarEvent `json:"event,omitempty"`
+	Before      *calendarEvent `json:"before,omitempty"`
+	Override    *planOverride  `json:"override,omitempty"`
+	Mail        *message       `json:"mail,omitempty"`
+	Destination string         `json:"destination,omitempty"`
+	Message     string         `json:"message,omitempty"`
+	Audit       []auditEntry   `json:"audit,omitempty"`
+}
+
+type planOverride struct {
+	Day      time.Time `json:"day"`
+	Role     string    `json:"role"`
+	Alias    string    `json:"alias"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Schedule string    `json:"schedule"`
+	Email    string    `json:"email"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// The plan being made, if this is "rotator plan".
+var activePlan *rotaPlan
+
+// planBackend passes reads through to the real calendar (noting a checksum
+// of each), and records writes in the plan instead of making them. Reads
+// see the planned changes, so the rest of rotator works as usual.
+type planBackend struct {
+	cal     CalendarBackend
+	plan    *rotaPlan
+	seen    map[string]*calendarEvent
+	pending map[string]*planOp
+	reads   map[string]bool
+	nextID  int
+}
+
+func newPlanBackend(cal CalendarBackend, plan *rotaPlan) *planBackend {
+	return &planBackend{
+		cal:     cal,
+		plan:    plan,
+		seen:    make(map[string]*calendarEvent),
+		pending: make(map[string]*planOp),
+		reads:   make(map[string]bool),
+	}
+}
+
+func copyEvent(e *calendarEvent) *calendarEvent {
+	c := *e
+	c.Attendees = append([]string{}, e.Attendees...)
+	return &c
+}
+
+// hashEvents is a checksum of a query result that doesn't depend on the
+// order events come back in.
+func hashEvents(events []*calendarEvent) string {
+	sorted := append([]*calendarEvent{}, events...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	data, _ := json.Marshal(sorted)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (p *planBackend) ListEvents(calendarID string, start time.Time, end time.Time) ([]*calendarEvent, error) {
+	events, err := p.cal.ListEvents(calendarID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	readKey := fmt.Sprintf("%s|%d|%d", calendarID, start.Unix(), end.Unix())
+	if !p.reads[readKey] {
+		p.reads[readKey] = true
+		p.plan.Reads = append(p.plan.Reads, planRead{calendarID, start, end, hashEvents(events)})
+	}
+
+	result := []*calendarEvent{}
+	for _, e := range events {
+		key := calendarID + "|" + e.ID
+		p.seen[key] = copyEvent(e)
+		if op, ok := p.pending[key]; ok {
+			if op.Kind != "delete" {
+				result = append(result, copyEvent(op.Event))
+			}
+			continue
+		}
+		result = append(result, copyEvent(e))
+	}
+	for _, op := range p.plan.Ops {
+		if op.Kind == "insert" && op.Calendar == calendarID && op.Event.overlaps(start, end) {
+			result = append(result, copyEvent(op.Event))
+		}
+	}
+	return result, nil
+}
+
+func (p *planBackend) LoadRange(calendarID string, start time.Time, end time.Time) error {
+	return loadRange(p.cal, calendarID, start, end)
+}
+
+func (p *planBackend) InsertEvent(calendarID string, event *calendarEvent) error {
+	p.nextID++
+	event.ID = fmt.Sprintf("plan-%d", p.nextID)
+	op := &planOp{Kind: "insert", Rotation: activeRotation, Calendar: calendarID, Event: copyEvent(event)}
+	p.plan.Ops = append(p.plan.Ops, op)
+	p.pending[calendarID+"|"+event.ID] = op
+	return nil
+}
+
+func (p *planBackend) UpdateEvent(calendarID string, event *calendarEvent) error {
+	key := calendarID + "|" + event.ID
+	// Changing a planned event just changes the plan.
+	if op, ok := p.pending[key]; ok && op.Kind != "delete" {
+		op.Event = copyEvent(event)
+		return nil
+	}
+	op := &planOp{Kind: "update", Rotation: activeRotation, Calendar: calendarID,
+		Event: copyEvent(event), Before: p.seen[key]}
+	p.plan.Ops = append(p.plan.Ops, op)
+	p.pending[key] = op
+	return nil
+}
+
+func (p *planBackend) DeleteEvent(calendarID string, eventID string) error {
+	key := calendarID + "|" + eventID
+	if op, ok := p.pending[key]; ok && op.Kind == "insert" {
+		for i, o := range p.plan.Ops {
+			if o == op {
+				p.plan.Ops = append(p.plan.Ops[:i], p.plan.Ops[i+1:]...)
+				break
+			}
+		}
+		delete(p.pending, key)
+		return nil
+	}
+	op := &planOp{Kind: "delete", Rotation: activeRotation, Calendar: calendarID,
+		Event: &calendarEvent{ID: eventID}, Before: p.seen[key]}
+	p.plan.Ops = append(p.plan.Ops, op)
+	p.pending[key] = op
+	return nil
+}
+
+// planNotification records a message instead of sending it.
+func planNotification(op *planOp) {
+	op.Rotation = activeRotation
+	activePlan.Ops = append(activePlan.Ops, op)
+}
+
+func writePlan(path string, plan *rotaPlan) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+func describeEvent(e *calendarEvent) string {
+	if e == nil {
+		return "?"
+	}
+	if e.AllDay {
+		return fmt.Sprintf("%s %q", dateFormat(e.Start), e.Summary)
+	}
+	return fmt.Sprintf("%s-%s %q", e.Start.In(rotaLocation).Format("2006-01-02 15:04"),
+		e.End.In(rotaLocation).Format("15:04"), e.Summary)
+}
+
+// describeOp is a one-line summary of op for humans.
+func describeOp(op *planOp) string {
+	prefix := ""
+	if op.Rotation != "" {
+		prefix = "[" + op.Rotation + "] "
+	}
+	switch op.Kind {
+	case "insert":
+		return prefix + "+ " + describeEvent(op.Event)
+	case "update":
+		return prefix + "~ " + describeEvent(op.Before) + " -> " + describeEvent(op.Event)
+	case "delete":
+		return prefix + "- " + describeEvent(op.Before)
+	case "opsgenie":
+		o := op.Override
+		return fmt.Sprintf("%sopsgenie %s: %s %s-%s (%s)", prefix, o.Alias, o.Email,
+			o.Start.Format(ogTimeString), o.End.Format(ogTimeString), o.Schedule)
+	case "mail":
+		return fmt.Sprintf("%smail to %s: %s", prefix, op.Mail.Destination, op.Mail.Subject)
+	default:
+		return fmt.Sprintf("%s%s to %s: %s", prefix, op.Kind, op.Destination, op.Message)
+	}
+}
+
+// applyCommand handles "apply FILE".
+func applyCommand(cal CalendarBackend, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: apply PLANFILE")
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	var plan rotaPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return fmt.Errorf("%s: %s", args[0], err)
+	}
+
+	for _, r := range plan.Reads {
+		events, err := cal.ListEvents(r.Calendar, r.Start, r.End)
+		if err != nil {
+			return err
+		}
+		if hashEvents(events) != r.Hash {
+			return fmt.Errorf("calendar %s has changed since the plan was made (%s to %s), make a new plan",
+				r.Calendar, r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339))
+		}
+	}
+
+	rotation := ""
+	for _, op := range plan.Ops {
+		if op.Rotation != rotation {
+			if err := switchRotation(op.Rotation); err != nil {
+				return err
+			}
+			rotation = op.Rotation
+		}
+		if *flagVerbose {
+			fmt.Println(describeOp(op))
+		}
+		switch op.Kind {
+		case "insert":
+			err = cal.InsertEvent(op.Calendar, op.Event)
+		case "update":
+			err = cal.UpdateEvent(op.Calendar, op.Event)
+		case "delete":
+			err = cal.DeleteEvent(op.Calendar, op.Event.ID)
+		case "opsgenie":
+			o := op.Override
+			if config.OpsGenie.APIKey != "" {
+				err = ogWriteOverride(o.Day, o.Role, o.Alias, o.Start, o.End, o.Schedule, o.Email, o.Reason)
+			}
+		case "mail":
+			if config.MailServer == "" {
+				config.MailServer = "localhost:25"
+			}
+			err = mailSend(*op.Mail, config.MailServer)
+		case "slack":
+			err = doSlackNotify(op.Message, op.Destination)
+		case "slack-dm":
+			err = doSlackDM(op.Message, op.Destination)
+		default:
+			err = fmt.Errorf("unknown kind of change %q", op.Kind)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", describeOp(op), err)
+		}
+		for _, e := range op.Audit {
+			e.Time = time.Now()
+			e.Run = runID
+			appendAudit(e)
+		}
+	}
+
+	fmt.Printf("Applied %d changes from %s\n", len(plan.Ops), args[0])
+	return nil
+}
+
+// planSummary prints what the plan would do.
+func planSummary(plan *rotaPlan, path string) {
+	for _, op := range plan.Ops {
+		fmt.Println(describeOp(op))
+	}
+	fmt.Printf("%d changes saved to %s, apply with: rotator apply %s\n",
+		len(plan.Ops), path, path)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A follow-the-sun rotation splits every day into regional shifts, each
+// covered by the region's own people during its own hours, e.g.
+//
+//	regions:
+//	  - name: vienna
+//	    timezone: Europe/Vienna
+//	    start: "08:00"
+//	    end: "16:00"
+//	    oncallers: [aa, bob]
+//
+// Each region is scheduled like a rotation of its own (same availability
+// checks, limits and scheduler) over the rota's calendar dates, but its
+// events are timed rather than all-day, and tagged with the region name:
+// "aa onduty (vienna)". Oncallers are codes from the rotation's Oncallers,
+// and keep their relative order. A shift whose end isn't after its start
+// runs past midnight.
+type regionConfig struct {
+	Name      string
+	TimeZone  string
+	Start     string
+	End       string
+	Oncallers []string
+}
+
+// The region being worked on, if any, and its time zone.
+var activeRegion *regionConfig
+var regionLocation = time.Local
+
+// useRegion narrows the active rotation (base) down to region r, or
+// widens it back out again if r is nil. The regions have to have passed
+// checkRegions.
+func useRegion(base Config, r *regionConfig) {
+	config = base
+	activeRegion = r
+	if r != nil {
+		byOrder := make(map[int]oncallPerson)
+		for _, person := range base.Oncallers {
+			byOrder[person.Order] = person
+		}
+		config.Regions = nil
+		config.Oncallers = nil
+		for x := 0; x < len(base.Oncallers); x++ {
+			person := byOrder[x]
+			if isListed(person.Code, r.Oncallers) {
+				person.Order = len(config.Oncallers)
+				config.Oncallers = append(config.Oncallers, person)
+			}
+		}
+	}
+
+	setupRotation()
+
+	if r != nil {
+		loc, err := regionZone(r)
+		if err != nil {
+			// ruled out by checkRegions
+			loc = rotaLocation
+		}
+		regionLocation = loc
+	}
+}
+
+// checkRegions makes sure the active rotation's regions make sense, before
+// anything is written: useRegion doesn't stop to check halfway through.
+func checkRegions() error {
+	for i := range config.Regions {
+		r := &config.Regions[i]
+		for _, code := range r.Oncallers {
+			if _, ok := oncallersByCode[code]; !ok {
+				return fmt.Errorf("region %s: unknown oncaller %q", r.Name, code)
+			}
+		}
+		if _, err := regionZone(r); err != nil {
+			return fmt.Errorf("region %s: %v", r.Name, err)
+		}
+		for _, clock := range []string{r.Start, r.End} {
+			if _, err := time.Parse("15:04", clock); err != nil {
+				return fmt.Errorf("region %s: bad shift time %q (want HH:MM)", r.Name, clock)
+			}
+		}
+	}
+	return nil
+}
+
+// regionZone is r's time zone, or the rota's if it has none of its own.
+func regionZone(r *regionConfig) (*time.Location, error) {
+	if r.TimeZone == "" {
+		return rotaLocation, nil
+	}
+	return time.LoadLocation(r.TimeZone)
+}
+
+// roleWindow is the time covered by an oncall (or backup) event for day:
+// the whole day, or the active region's shift.
+func roleWindow(day time.Time) (time.Time, time.Time, bool) {
+	if activeRegion == nil {
+		return dayStart(day), dayStart(day.AddDate(0, 0, 1)), true
+	}
+	start := atClockIn(day, activeRegion.Start, regionLocation)
+	end := atClockIn(day, activeRegion.End, regionLocation)
+	if !end.After(start) {
+		end = atClockIn(day.AddDate(0, 0, 1), activeRegion.End, regionLocation)
+	}
+	return start, end, false
+}
+
+// regionTag is added to event titles written for the active region, and
+// regionPattern matches it.
+func regionTag() string {
+	if activeRegion == nil {
+		return ""
+	}
+	return " (" + activeRegion.Name + ")"
+}
+
+func regionPattern() string {
+	if activeRegion == nil {
+		return ""
+	}
+	return `\s*\(` + regexp.QuoteMeta(activeRegion.Name) + `\)`
+}
+
+// regionSlug identifies the active region in OpsGenie aliases and UIDs.
+func regionSlug() string {
+	if activeRegion == nil {
+		return ""
+	}
+	return "-" + strings.Replace(strings.ToLower(activeRegion.Name), " ", "-", -1)
+}
+
+// oncallAt finds out who is oncall at t: whoever has that day, or in a
+// follow-the-sun rotation whoever's regional shift t falls into.
+func oncallAt(cal CalendarBackend, t time.Time) (*oncallDay, error) {
+	t = t.In(rotaLocation)
+	if len(config.Regions) == 0 {
+		if d, ok := oncall.Days[dateFormat(t)]; ok {
+			return d, nil
+		}
+		d, err := getOncallByDay(cal, t)
+		if err != nil {
+			return nil, err
+		}
+		oncall.Days[dateFormat(t)] = d
+		return d, nil
+	}
+
+	// Only each region's shift and event titles matter here, so rather
+	// than setting the whole region up with useRegion (which would start
+	// the rotation's state afresh), just point roleWindow and
+	// regionPattern at it.
+	savedRegion, savedLocation := activeRegion, regionLocation
+	defer func() {
+		activeRegion, regionLocation = savedRegion, savedLocation
+	}()
+	for i := range config.Regions {
+		r := &config.Regions[i]
+		loc, err := regionZone(r)
+		if err != nil {
+			return nil, fmt.Errorf("region %s: %v", r.Name, err)
+		}
+		activeRegion, regionLocation = r, loc
+		// shifts in other time zones may belong to a neighbouring date
+		for _, x := range []int{0, -1, 1} {
+			day := t.AddDate(0, 0, x)
+			start, end, _ := roleWindow(day)
+			if !t.Before(start) && t.Before(end) {
+				return getOncallByDay(cal, day)
+			}
+		}
+	}
+	return &oncallDay{}, nil
+}
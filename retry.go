@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Calendar API calls that hit a rate limit (429, or Google's 403
+// rateLimitExceeded) or a server error (5xx) are tried again after an
+// exponentially growing, jittered delay, or as long as the server asks
+// with Retry-After (up to retryMaxDelay; if it asks for longer, the call
+// fails). So are calls that fail to get through at all. POSTs
+// (inserts, watch channels) are never tried again: one that failed might
+// have been carried out anyway, and a second go would do it twice.
+// RetryAttempts in the config caps the number of attempts per call.
+const defaultRetryAttempts = 5
+
+var (
+	retryBaseDelay = time.Second
+	retryMaxDelay  = 32 * time.Second
+	retrySleep     = time.Sleep
+)
+
+// retryStats counts what the retrying went through in this run.
+var retryStats struct {
+	Requests    int
+	Retries     int
+	RateLimited int
+	ServerError int
+	NetError    int
+	GaveUp      int
+	Waited      time.Duration
+}
+
+type retryTransport struct {
+	base http.RoundTripper
+}
+
+// newRetryTransport wraps base (http.DefaultTransport if nil).
+func newRetryTransport(base http.RoundTripper) *retryTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &retryTransport{base: base}
+}
+
+func retryAttempts() int {
+	if config.RetryAttempts > 0 {
+		return config.RetryAttempts
+	}
+	return defaultRetryAttempts
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := retryAttempts()
+	// We can only send a body again if we can get a fresh copy of it.
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		retryStats.Requests++
+		try := req
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			copy := *req
+			copy.Body = body
+			try = &copy
+		}
+		resp, err := t.base.RoundTrip(try)
+		retry, wait := shouldRetry(req, resp, err)
+		if !retry {
+			return resp, err
+		}
+		// A server that wants us to wait longer than retryMaxDelay can have
+		// its error instead: a run (or a watch cycle) shouldn't stall.
+		if attempt >= attempts || wait > retryMaxDelay {
+			retryStats.GaveUp++
+			return resp, err
+		}
+		if wait == 0 {
+			wait = backoffDelay(attempt)
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if *flagDebug {
+			fmt.Printf("%s %s failed (%s), retrying in %s\n", req.Method, req.URL.Path,
+				describeRetry(resp, err), wait)
+		}
+		if err := req.Context().Err(); err != nil {
+			return nil, err
+		}
+		retryStats.Retries++
+		retryStats.Waited += wait
+		retrySleep(wait)
+	}
+}
+
+// shouldRetry decides whether a response (or error) is worth another go,
+// and how long the server wants us to wait first (0 if it didn't say).
+func shouldRetry(req *http.Request, resp *http.Response, err error) (bool, time.Duration) {
+	if err != nil {
+		retryStats.NetError++
+		return idempotent(req), 0
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		retryStats.RateLimited++
+	case resp.StatusCode == http.StatusForbidden && isRateLimitBody(resp):
+		retryStats.RateLimited++
+	case resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented:
+		retryStats.ServerError++
+	default:
+		return false, 0
+	}
+	return idempotent(req), retryAfter(resp)
+}
+
+// idempotent tells whether req can safely be sent twice.
+func idempotent(req *http.Request) bool {
+	return req.Method != "POST" && req.Method != "PATCH"
+}
+
+// isRateLimitBody tells Google's rate limit 403s from permission errors.
+// The body is put back for whoever reads the response next.
+func isRateLimitBody(resp *http.Response) bool {
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	return bytes.Contains(data, []byte("rateLimitExceeded")) ||
+		bytes.Contains(data, []byte("userRateLimitExceeded"))
+}
+
+// retryAfter reads a Retry-After header, in seconds or as a date.
+func retryAfter(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(when); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// backoffDelay is the wait before attempt+1: the base delay doubling every
+// time up to the maximum, of which a random half is taken off.
+func backoffDelay(attempt int) time.Duration {
+	d := retryBaseDelay << uint(attempt-1)
+	if d > retryMaxDelay || d <= 0 {
+		d = retryMaxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func describeRetry(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return resp.Status
+}
+
+// retrySummary reports on the retrying, with -v, if there was any.
+func retrySummary() {
+	if !*flagVerbose || retryStats.Retries+retryStats.GaveUp == 0 {
+		return
+	}
+	fmt.Printf("Calendar API: %d requests, %d retries (%d rate limited, %d server errors, "+
+		"%d network errors), gave up %d times, waited %s\n",
+		retryStats.Requests, retryStats.Retries, retryStats.RateLimited, retryStats.ServerError,
+		retryStats.NetError, retryStats.GaveUp, retryStats.Waited)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// retryResponse is one scripted reply of a retryServer.
+type retryResponse struct {
+	status int
+	header map[string]string
+	body   string
+}
+
+// retryServer replies to the nth request with the nth response (and "ok"
+// once they run out), and keeps the request bodies.
+type retryServer struct {
+	responses []retryResponse
+	bodies    []string
+}
+
+func (s *retryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.bodies = append(s.bodies, string(body))
+	if len(s.bodies) > len(s.responses) {
+		w.Write([]byte("ok"))
+		return
+	}
+	resp := s.responses[len(s.bodies)-1]
+	for k, v := range resp.header {
+		w.Header().Set(k, v)
+	}
+	w.WriteHeader(resp.status)
+	w.Write([]byte(resp.body))
+}
+
+// setupRetry sends requests through a retryTransport to a retryServer with
+// responses, and notes the waits in between instead of sleeping.
+func setupRetry(t *testing.T, responses ...retryResponse) (*retryServer, *httptest.Server, *http.Client, *[]time.Duration) {
+	setupTest(t, "")
+	waits := []time.Duration{}
+	savedSleep, savedBase := retrySleep, retryBaseDelay
+	retrySleep = func(d time.Duration) { waits = append(waits, d) }
+	retryBaseDelay = 100 * time.Millisecond
+	s := &retryServer{responses: responses}
+	srv := httptest.NewServer(s)
+	t.Cleanup(func() {
+		srv.Close()
+		retrySleep, retryBaseDelay = savedSleep, savedBase
+	})
+	return s, srv, &http.Client{Transport: newRetryTransport(nil)}, &waits
+}
+
+// readBody reads a whole response, or says what went wrong.
+func readBody(resp *http.Response, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	return string(data)
+}
+
+func TestRetryForbidden(t *testing.T) {
+	s, srv, cli, waits := setupRetry(t,
+		retryResponse{status: 403, body: `{"error":{"errors":[{"reason":"rateLimitExceeded"}]}}`},
+		retryResponse{status: 403, body: `{"error":{"errors":[{"reason":"forbidden"}]}}`})
+
+	// The rate limit is tried again, the permission error isn't, and its
+	// body is still there to be read.
+	got := readBody(cli.Get(srv.URL))
+	if len(s.bodies) != 2 || len(*waits) != 1 || !strings.Contains(got, `"forbidden"`) {
+		t.Errorf("%d requests, waits %v, got %q", len(s.bodies), *waits, got)
+	}
+}
+
+func TestRetryServerError(t *testing.T) {
+	s, srv, cli, waits := setupRetry(t,
+		retryResponse{status: 500}, retryResponse{status: 503}, retryResponse{status: 502})
+
+	if got := readBody(cli.Get(srv.URL)); got != "ok" || len(s.bodies) != 4 {
+		t.Fatalf("%d requests, got %q", len(s.bodies), got)
+	}
+	// doubling, less up to half of it
+	for x, wait := range *waits {
+		max := retryBaseDelay << uint(x)
+		if wait < max/2 || wait > max {
+			t.Errorf("wait %d: %s, want %s to %s", x+1, wait, max/2, max)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	when := time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat)
+	_, srv, cli, waits := setupRetry(t,
+		retryResponse{status: 429, header: map[string]string{"Retry-After": "7"}},
+		retryResponse{status: 503, header: map[string]string{"Retry-After": when}})
+
+	if got := readBody(cli.Get(srv.URL)); got != "ok" {
+		t.Fatalf("got %q", got)
+	}
+	if len(*waits) != 2 || (*waits)[0] != 7*time.Second ||
+		(*waits)[1] < 28*time.Second || (*waits)[1] > 30*time.Second {
+		t.Errorf("waits %v, want 7s and about 30s", *waits)
+	}
+}
+
+func TestRetryAfterTooLong(t *testing.T) {
+	for _, value := range []string{"3600", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)} {
+		s, srv, cli, waits := setupRetry(t,
+			retryResponse{status: 429, header: map[string]string{"Retry-After": value}})
+
+		resp, err := cli.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 429 || len(s.bodies) != 1 || len(*waits) != 0 {
+			t.Errorf("Retry-After %s: %d requests, waits %v, last %d", value, len(s.bodies), *waits, resp.StatusCode)
+		}
+	}
+}
+
+func TestRetryMaxAttempts(t *testing.T) {
+	s, srv, cli, _ := setupRetry(t,
+		retryResponse{status: 500}, retryResponse{status: 500}, retryResponse{status: 500},
+		retryResponse{status: 500})
+	config.RetryAttempts = 3
+
+	resp, err := cli.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 500 || len(s.bodies) != 3 {
+		t.Errorf("%d requests, last %d", len(s.bodies), resp.StatusCode)
+	}
+}
+
+func TestRetryReplaysBody(t *testing.T) {
+	s, srv, cli, _ := setupRetry(t, retryResponse{status: 429}, retryResponse{status: 500})
+
+	req, _ := http.NewRequest("PUT", srv.URL, strings.NewReader(`{"summary":"aa onduty"}`))
+	if got := readBody(cli.Do(req)); got != "ok" {
+		t.Fatalf("got %q", got)
+	}
+	for x, body := range s.bodies {
+		if body != `{"summary":"aa onduty"}` {
+			t.Errorf("attempt %d sent %q", x+1, body)
+		}
+	}
+}
+
+func TestRetryNotPost(t *testing.T) {
+	for _, status := range []int{429, 500, 503} {
+		s, srv, cli, _ := setupRetry(t, retryResponse{status: status})
+		resp, err := cli.Post(srv.URL, "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status || len(s.bodies) != 1 {
+			t.Errorf("POST with %d: %d requests", status, len(s.bodies))
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+// rotationConfig describes one of several independent rotations run from
+// the same config file. Anything left unset is taken from the top level
+// of the config, so credentials (mail, Slack key, calendar secrets, the
+// OpsGenie API key) only need to be given once. Each rotation's Oncallers
+// are numbered from Order 0, and a rotation with its own OncallCalendar
+// but no AvailabilityCalendar uses the former for both, as at top level.
+// BackupOncall, AustrianHolidays and the limits are pointers so that a
+// rotation can turn them off (false, 0) where the top level has them on.
+type rotationConfig struct {
+	Name                 string
+	OncallCalendar       string
+	AvailabilityCalendar string
+	GenerateDays         int
+	MaxDaysPerMonth      *int
+	MaxWeekendsPerMonth  *int
+	ShadowOncaller       string
+	SlackChannel         string
+	ShiftLength          int
+	HandoverWeekday      string
+	HandoverTime         string
+	TimeZone             string
+	WeekdayHandover      string
+	WeekendHandover      string
+	BackupOncall         *bool
+	Scheduler            string
+	FairnessWindow       int
+	AustrianHolidays     *bool
+	HolidayFiles         []string
+	Regions              []regionConfig
+	OpsGenie             ogConfig
+	Oncallers            []oncallPerson
+}
+
+// selectRotations returns the rotations to work on: all of them, or just
+// the one called name. A config without any rotations is treated as a
+// single unnamed one.
+func selectRotations(name string) []rotationConfig {
+	if len(baseConfig.Rotations) == 0 {
+		if name != "" {
+			return nil
+		}
+		return []rotationConfig{{}}
+	}
+	if name == "" {
+		return baseConfig.Rotations
+	}
+	for _, r := range baseConfig.Rotations {
+		if r.Name == name {
+			return []rotationConfig{r}
+		}
+	}
+	return nil
+}
+
+// useRotation makes r the active rotation, resetting all per-rotation state.
+func useRotation(r rotationConfig) {
+	config = baseConfig
+	activeRotation = r.Name
+	activeRegion = nil
+
+	if r.OncallCalendar != "" {
+		config.OncallCalendar = r.OncallCalendar
+		// don't inherit a shared availability calendar by accident
+		config.AvailabilityCalendar = r.AvailabilityCalendar
+	}
+	if r.AvailabilityCalendar != "" {
+		config.AvailabilityCalendar = r.AvailabilityCalendar
+	}
+	if r.GenerateDays != 0 {
+		config.GenerateDays = r.GenerateDays
+	}
+	if r.MaxDaysPerMonth != nil {
+		config.MaxDaysPerMonth = *r.MaxDaysPerMonth
+	}
+	if r.MaxWeekendsPerMonth != nil {
+		config.MaxWeekendsPerMonth = *r.MaxWeekendsPerMonth
+	}
+	if r.ShadowOncaller != "" {
+		config.ShadowOncaller = r.ShadowOncaller
+	}
+	if r.SlackChannel != "" {
+		config.SlackChannel = r.SlackChannel
+	}
+	if r.ShiftLength != 0 {
+		config.ShiftLength = r.ShiftLength
+	}
+	if r.HandoverWeekday != "" {
+		config.HandoverWeekday = r.HandoverWeekday
+	}
+	if r.HandoverTime != "" {
+		config.HandoverTime = r.HandoverTime
+	}
+	if r.TimeZone != "" {
+		config.TimeZone = r.TimeZone
+	}
+	if r.WeekdayHandover != "" {
+		config.WeekdayHandover = r.WeekdayHandover
+	}
+	if r.WeekendHandover != "" {
+		config.WeekendHandover = r.WeekendHandover
+	}
+	if r.BackupOncall != nil {
+		config.BackupOncall = *r.BackupOncall
+	}
+	if r.Scheduler != "" {
+		config.Scheduler = r.Scheduler
+	}
+	if r.FairnessWindow != 0 {
+		config.FairnessWindow = r.FairnessWindow
+	}
+	if r.AustrianHolidays != nil {
+		config.AustrianHolidays = r.AustrianHolidays
+	}
+	if len(r.HolidayFiles) != 0 {
+		config.HolidayFiles = r.HolidayFiles
+	}
+	if len(r.Regions) != 0 {
+		config.Regions = r.Regions
+	}
+	if r.OpsGenie.ScheduleID != "" {
+		apikey := config.OpsGenie.APIKey
+		config.OpsGenie = r.OpsGenie
+		if config.OpsGenie.APIKey == "" {
+			config.OpsGenie.APIKey = apikey
+		}
+	}
+	if len(r.Oncallers) != 0 {
+		config.Oncallers = r.Oncallers
+	}
+
+	setupRotation()
+}
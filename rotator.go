@@ -5,12 +5,12 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"syscall"
 	"time"
-
-	"github.com/uffish/holidays"
-	"github.com/uffish/holidays/austria"
 )
 
 // Config is mostly self-explanatory, although:
@@ -18,8 +18,46 @@ import (
 // MaxWeekendsPerMonth: No more than this number of weekends/month/person
 // ShadowOncaller: Will be listed as oncall if no oncaller can be found
 // given the restrictions above - defaults to 'xx'
+// ShiftLength: Days per shift (default 1, i.e. day-by-day rotation)
+// HandoverWeekday: Weekday multi-day shifts start on (e.g. "monday")
+// HandoverTime: HH:MM at which the OpsGenie override changes hands
+// TimeZone: IANA time zone the rota's days are in (default: local time)
+// WeekdayHandover, WeekendHandover: HH:MM the OpsGenie override starts
+// on weekdays (default 08:00) and weekends (10:00), unless HandoverTime
+// is set
+// BackupOncall: Also assign a secondary ("xx backup") oncaller every day
+// Scheduler: "rotation" (default) walks the rotation order day by day;
+// "fair" plans the whole window to even out load, see fair.go
+// FairnessWindow: Days of history the fair scheduler takes into account
+// AustrianHolidays: Count Austria's public holidays, the only ones built
+// in (default true); for other countries, list them in HolidayFiles
+// HolidayFiles: YAML or iCalendar files listing further public holidays
+// HolidayRegions: Regional holiday files by region name, see HolidayRegion
+// Regions: Splits every day into follow-the-sun shifts, see regions.go
+// AuditLog: JSON lines file logging every change made, see audit.go
+// StateFile: JSON file keeping a local record of the rota, see state.go
+// RetryAttempts: How often to try each calendar API call before giving
+// up (default 5), see retry.go
+// JournalDir: Directory keeping a journal of each run's changes for
+// rollback, see journal.go
+// SyncCache: JSON file keeping the calendars between runs, so only changes
+// need fetching (Google backend only), see sync.go
+// Watch: Where "rotator watch" takes change notifications, see watch.go
+// SecretFile: Google OAuth client secret or service account key, see auth.go
+// TokenFile: Where the OAuth token is kept (default
+// ~/.credentials/calendar-go.json)
+// ImpersonateUser: The user a service account acts as (domain-wide
+// delegation)
+// Rotations: Optional list of independent rotations sharing this config,
+// see rotationConfig
+// CalDAVServer etc.: only used by the "caldav" backend, in which case the
+// calendars are collection paths (or URLs) on that server. With the "ics"
+// backend the calendars are .ics files or directories of them.
 type Config struct {
+	CalendarBackend      string // "google" (default), "caldav" or "ics"
 	SecretFile           string
+	TokenFile            string
+	ImpersonateUser      string
 	GenerateDays         int
 	MaxDaysPerMonth      int
 	MaxWeekendsPerMonth  int
@@ -27,18 +65,44 @@ type Config struct {
 	MailSender           string
 	AvailabilityCalendar string
 	OncallCalendar       string
+	CalDAVServer         string
+	CalDAVUsername       string
+	CalDAVPassword       string
 	SlackEmergency       bool // Send Slack notification if the oncaller changes
 	SlackKey             string
 	SlackChannel         string
 	ShadowOncaller       string
+	ShiftLength          int
+	HandoverWeekday      string
+	HandoverTime         string
+	TimeZone             string
+	WeekdayHandover      string
+	WeekendHandover      string
+	BackupOncall         bool
+	Scheduler            string
+	FairnessWindow       int
+	AustrianHolidays     *bool
+	HolidayFiles         []string
+	HolidayRegions       map[string]string
+	Regions              []regionConfig
 	OpsGenie             ogConfig
+	StateFile            string
+	AuditLog             string
+	JournalDir           string
+	RetryAttempts        int
+	SyncCache            string
+	Watch                watchConfig
 	AwayWords            []string
 	Oncallers            []oncallPerson
+	Rotations            []rotationConfig
 }
 
+// Backup is the secondary oncaller, only used with BackupOncall.
 type oncallDay struct {
-	Victim oncallPerson
-	Fixed  bool
+	Victim      oncallPerson
+	Fixed       bool
+	Backup      oncallPerson
+	BackupFixed bool
 }
 
 type oncallDaySet struct {
@@ -49,13 +113,25 @@ type oncallDaySet struct {
 // Code: 2-3 letter identification code (usually initials)
 // CalendarEmail: Google Calendar account email address
 // Email: email address for notifications.
+// Weight: share of a full-time load (e.g. 0.5), scales the monthly limits
+// NeverWeekdays: weekdays (e.g. "friday") this person never covers
+// PreferredWeekdays: weekdays this person is picked for ahead of their turn
+// MaxConsecutiveDays: no more than this many days in a row
+// MinRestDays: at least this many days off between shifts
+// HolidayRegion: key into Config.HolidayRegions; off on those holidays
 type oncallPerson struct {
-	Order         int
-	Code          string
-	CalendarEmail string
-	Email         string
-	Phone         string
-	SlackID       string
+	Order              int
+	Code               string
+	CalendarEmail      string
+	Email              string
+	Phone              string
+	SlackID            string
+	Weight             float64
+	NeverWeekdays      []string
+	PreferredWeekdays  []string
+	MaxConsecutiveDays int
+	MinRestDays        int
+	HolidayRegion      string
 }
 
 type restriction struct {
@@ -70,6 +146,7 @@ type restrictionSet struct {
 }
 
 var config Config
+var baseConfig Config
 var oncallersByCode map[string]oncallPerson
 var oncallersByOrder map[int]oncallPerson
 var oncall oncallDaySet
@@ -82,7 +159,9 @@ var (
 	lastOn         = flag.String("laston", "", "Seed rota with yesterday's oncall person")
 	generateDays   = flag.Int("days", 0, "Number of days of rota to generate (overrides config file)")
 	configFile     = flag.String("configfile", "rotator.yaml", "Where to look for config file")
+	rotationName   = flag.String("rotation", "", "Only handle the named rotation (default: all of them)")
 	monitorFile    = flag.String("monitoring.file", "", "If set, write monitoring status to file and exit.")
+	exportDir      = flag.String("export.dir", "", "If set, write iCalendar feeds of the rota to this directory.")
 	notifyVictim   = flag.String("notify", "", "Send mail to whoever is oncall [today] or [tomorrow].")
 	notifySlack    = flag.Bool("slack", false, "Send Slack notifications to/of the current oncaller.")
 	flagDebug      = flag.Bool("d", false, "Print spammy debugging information")
@@ -90,13 +169,32 @@ var (
 	flagVerbose    = flag.Bool("v", false, "Be a bit more verbose")
 	flagDryRun     = flag.Bool("dry_run", false, "Don't actually write any calendar entries")
 	flagUnrestrict = flag.Bool("unrestrict", false, "Start restrictions from zero (for recasting schedule)")
+	flagOnError    = flag.String("on_error", "continue", "When a day can't be written: [continue] with the next or [stop]")
 )
 
 func init() {
 	flag.Parse()
+	if *flagOnError != "continue" && *flagOnError != "stop" {
+		log.Fatalf("-on_error must be continue or stop, not %q", *flagOnError)
+	}
 
 	config = unpackConfig(*configFile)
+	baseConfig = config
+
+	var awaywords string
+	if len(config.AwayWords) != 0 {
+		awaywords = strings.Join(config.AwayWords, "|")
+	} else {
+		awaywords = "away|urlaub|krank|vacation|leave|familienzeit|za"
+	}
+	holidayRE = regexp.MustCompile(`(?i)(\w{2,3})[\s-]+(` + awaywords + `)`)
+
+	setupRotation()
+}
 
+// setupRotation (re)initialises everything derived from the per-rotation
+// parts of the config.
+func setupRotation() {
 	if config.ShadowOncaller != "" {
 		oncallerShadow.Code = config.ShadowOncaller
 	} else {
@@ -114,57 +212,205 @@ func init() {
 	}
 
 	oncall.Days = make(map[string]*oncallDay)
+	restrictions = restrictionSet{}
+
+	if err := loadTimeZone(); err != nil {
+		log.Fatalf("Unable to set up time zone: %v", err)
+	}
+	if err := loadHolidays(); err != nil {
+		log.Fatalf("Unable to load holidays: %v", err)
+	}
+	if err := loadState(); err != nil {
+		log.Fatalf("Unable to load state file: %v", err)
+	}
 
 	// If only OncallCalendar is specified, assume the same calendar should
 	// be used for availability information.
 	if config.OncallCalendar != "" && config.AvailabilityCalendar == "" {
 		config.AvailabilityCalendar = config.OncallCalendar
 	}
-
-	var awaywords string
-	if len(config.AwayWords) != 0 {
-		awaywords = strings.Join(config.AwayWords, "|")
-	} else {
-		awaywords = "away|urlaub|krank|vacation|leave|familienzeit|za"
-	}
-	holidayRE = regexp.MustCompile(`(?i)(\w{2,3})[\s-]+(` + awaywords + `)`)
 }
 
 func main() {
 
-	var firstDate time.Time
-	var lastOncall oncallPerson
+	cal, err := initBackend()
+	if err != nil {
+		log.Fatalf("Unable to initialise calendar client: %v", err)
+	}
+	backend := cal
+	// Load whole ranges of the calendars at once, and keep track of what
+	// we change, so it can be rolled back.
+	cal = newJournalBackend(newCacheBackend(cal))
+	if *flagDebug {
+		fmt.Printf("Run ID: %s\n", runID)
+	}
 
-	if *startDate == "" {
-		firstDate = time.Now()
-	} else {
-		firstDate, _ = time.Parse("2006-01-02", *startDate)
+	rotations := selectRotations(*rotationName)
+	if len(rotations) == 0 {
+		log.Fatalf("No rotation called %q in %s", *rotationName, *configFile)
+	}
+	// Regions are only used halfway through a run, so check them now.
+	for _, r := range rotations {
+		useRotation(r)
+		if err := checkRegions(); err != nil {
+			log.Fatalf("Unable to use %s: %v", describeRotation(r.Name), err)
+		}
 	}
 
-	srv, err := initCalendar(config.SecretFile)
-	if err != nil {
-		log.Fatalf("Unable to initialise calendar client: %v", err)
+	// Watching is a series of runs of its own, until we're stopped.
+	if flag.Arg(0) == "watch" {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		if err := watchCommand(backend, rotations, stop); err != nil {
+			log.Fatalf("watch: %v", err)
+		}
+		return
+	}
+
+	// A plan is a normal run, with the changes saved for later.
+	planFile := ""
+	if flag.Arg(0) == "plan" {
+		planFile = "rotator-plan.json"
+		if flag.NArg() > 1 {
+			planFile = flag.Arg(1)
+		}
+		activePlan = &rotaPlan{Created: time.Now(), Args: os.Args[1:]}
+		cal = newPlanBackend(cal, activePlan)
+	} else if flag.NArg() > 0 {
+		// Other commands work on a single rotation (history can filter
+		// them itself, and apply and rollback switch to whichever
+		// rotation each change belongs to).
+		if len(rotations) > 1 && !isListed(flag.Arg(0), []string{"history", "apply", "rollback"}) {
+			log.Fatalf("%s: pick a rotation with -rotation", flag.Arg(0))
+		}
+		useRotation(rotations[0])
+		err := runCommand(cal, flag.Args())
+		if err := saveState(); err != nil {
+			log.Fatalf("Unable to save state file: %v", err)
+		}
+		if err := saveSyncCache(); err != nil {
+			log.Fatalf("Unable to save sync cache: %v", err)
+		}
+		journalSummary()
+		retrySummary()
+		if err != nil && err != errStopped {
+			log.Fatalf("%s: %v", flag.Arg(0), err)
+		}
+		if len(failures) > 0 {
+			failureSummary()
+			os.Exit(1)
+		}
+		return
 	}
 
-	// Stash today's oncaller for future reference (may be empty)
-	oncall.Days[dateFormat(time.Now())] = getOncallByDay(srv, time.Now())
-	todayOncaller := oncall.Days[dateFormat(time.Now())].Victim
+	monitoring := []string{}
+	for _, r := range rotations {
+		useRotation(r)
 
-	// Print oncaller and exit if that's all we need to do.
+		// Stash today's oncaller for future reference (may be empty)
+		current, err := oncallAt(cal, rotaNow())
+		if err != nil {
+			if failDay(time.Time{}, "calendar", err) != nil {
+				break
+			}
+			continue
+		}
+		todayOncaller := current.Victim
+
+		// Whoever covers part of the day takes over meanwhile.
+		if *flagPrintOnly || *monitorFile != "" {
+			cover, ok, err := coverAt(cal, time.Now())
+			if err != nil {
+				if failDay(time.Time{}, "calendar", err) != nil {
+					break
+				}
+				continue
+			}
+			if ok {
+				todayOncaller = cover
+			}
+		}
+
+		if *flagPrintOnly {
+			if len(rotations) > 1 {
+				fmt.Printf("%s,", r.Name)
+			}
+			fmt.Printf("%s,%s\n", todayOncaller.Code, todayOncaller.Phone)
+			continue
+		}
+
+		if *monitorFile != "" {
+			monitoring = append(monitoring, monitoringStatus(r.Name,
+				todayOncaller.Code, current.Backup.Code, config.Oncallers)...)
+			continue
+		}
+
+		// Failures that don't belong to any one day still stop this
+		// rotation, and with -on_error=stop the whole run.
+		err = generateRota(cal, r.Name, todayOncaller, true)
+		if err != nil && err != errStopped {
+			err = failDay(time.Time{}, "calendar", err)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if activePlan != nil {
+		if err := writePlan(planFile, activePlan); err != nil {
+			log.Fatalf("Unable to write plan file: %v", err)
+		}
+		planSummary(activePlan, planFile)
+		if len(failures) > 0 {
+			failureSummary()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := saveState(); err != nil {
+		fmt.Printf("Error saving state file: %s\n", err)
+	}
+	if err := saveSyncCache(); err != nil {
+		fmt.Printf("Error saving sync cache: %s\n", err)
+	}
+	journalSummary()
+	retrySummary()
+	if len(failures) > 0 {
+		failureSummary()
+		os.Exit(1)
+	}
+
+	// Exit if printing the oncaller is all we needed to do.
 	if *flagPrintOnly {
-		fmt.Printf("%s,%s\n", todayOncaller.Code, todayOncaller.Phone)
 		os.Exit(1)
 	}
 
-	// Generate the monitoring file if that's all we need to do.
+	// Likewise if we only needed to generate the monitoring file.
 	if *monitorFile != "" {
-		err := writeMonitoringFile(todayOncaller.Code, config.Oncallers, *monitorFile)
+		err := writeMonitoringFile(monitoring, *monitorFile)
 		if err != nil {
 			fmt.Printf("Monitoring file creation failed: %s", err)
 			os.Exit(1)
 		}
 		os.Exit(0)
 	}
+}
+
+// generateRota does the actual work for the active rotation: fill in the
+// calendar for the coming days and tell people about it. Without
+// reminders (watch runs, which can come any number of times a day) only a
+// change of oncaller is announced; the usual Slack posts and -notify mails
+// are left to the scheduled runs.
+func generateRota(cal CalendarBackend, name string, todayOncaller oncallPerson, reminders bool) error {
+
+	var firstDate time.Time
+
+	if *startDate == "" {
+		firstDate = rotaNow()
+	} else {
+		firstDate, _ = parseDate(*startDate)
+	}
 
 	// Default to 30 days unless overridden
 	daysToRotate := 30
@@ -174,127 +420,101 @@ func main() {
 		daysToRotate = config.GenerateDays
 	}
 
-	// Load the existing rotation in advance (we'll need it all anyway)
-	firstOfMonth, daysToFetch := getMonthRange(firstDate, daysToRotate)
-
-	if *flagDebug {
-		fmt.Printf("Prefetching %d days...", daysToFetch)
-	}
-	for x := -1; x <= daysToFetch+1; x++ {
-		day := firstOfMonth.AddDate(0, 0, x)
-		oncall.Days[dateFormat(day)] = getOncallByDay(srv, day)
-	}
-	if *flagDebug {
-		fmt.Printf("done\n")
-	}
-
-	// get day-1 oncall to prime the rotation
-
-	if *lastOn != "" {
-		lastOncall = oncallersByCode[*lastOn]
-	} else if oncall.Days[dateFormat(firstDate.AddDate(0, 0, -1))].Victim.Code != "" {
-		lastOncall = oncall.Days[dateFormat(firstDate.AddDate(0, 0, -1))].Victim
-		if *flagDebug {
-			fmt.Printf("Yesterday's oncall (starting point) was: %s\n", lastOncall.Code)
+	if len(config.Regions) == 0 {
+		if err := fillRota(cal, firstDate, daysToRotate); err != nil {
+			return err
 		}
+		exportRota(name)
 	} else {
-		lastOncall = oncallersByOrder[0]
-	}
-
-	for x := 0; x < daysToRotate; x++ {
-		day := firstDate.AddDate(0, 0, x)
-		workday := true
-		hols := austria.GetHolidays()
-
-		if (holidays.CheckIsBusinessDay(day, hols) == false) &&
-			(holidays.CheckIsBusinessDay(day.AddDate(0, 0, -1), hols) == false) {
-			workday = false
-		}
-
-		unavailable, err := checkAvailability(srv, day)
-		if err != nil {
-			log.Fatalf("Unable to read calendar events: %v", err)
-		}
-
-		// check to see if there's a fixed entry - if so, skip from here
-		fixcheck := oncall.Days[dateFormat(day)]
-		if fixcheck.Fixed == true {
-			lastOncall = fixcheck.Victim
-			if *flagVerbose == true {
-				fmt.Printf("%s: %s # Fixed,Out: %s\n",
-					day.Format("Mon 2006-01-02"),
-					fixcheck.Victim.Code,
-					strings.Join(unavailable, ","))
+		// Each region in turn, then back to the rotation as a whole.
+		base := config
+		for i := range base.Regions {
+			useRegion(base, &base.Regions[i])
+			if err := fillRota(cal, firstDate, daysToRotate); err != nil {
+				useRegion(base, nil)
+				return err
 			}
-			continue
-		}
-
-		dayOncall := findNextOncall(unavailable, lastOncall, workday)
-		if *flagVerbose == true {
-			fmt.Printf("%s: %s # Out: %s\n",
-				day.Format("Mon 2006-01-02"),
-				dayOncall.Code,
-				strings.Join(unavailable, ","))
-		}
-
-		setOncallByDay(srv, day, dayOncall)
-		oncall.Days[dateFormat(day)] = &oncallDay{dayOncall, false}
-		// FIXME(mpk): Handle changing today's oncall via OpsGenie properly
-		// Call out to opsgenie here
-		if config.OpsGenie.APIKey != "" {
-			setOpsgenieByDay(day, dayOncall.Email)
+			exportRota(filepath.Join(name, base.Regions[i].Name))
 		}
-		lastOncall = dayOncall
+		useRegion(base, nil)
 	}
 
-	nowOncaller := oncall.Days[dateFormat(time.Now())].Victim
+	now := rotaNow()
+	current, err := oncallAt(cal, now)
+	if err != nil {
+		return err
+	}
+	nowOncaller := current.Victim
 
 	// Check to see if today's oncaller has changed
 	if todayOncaller.Code != nowOncaller.Code {
 		// Notify the new oncaller
 		err := doNotify(nowOncaller, "emergency")
 		if err != nil {
-			fmt.Printf("Error sending mail: %s\n", err)
+			if err := failDay(now, "mail", err); err != nil {
+				return err
+			}
 		}
 		if config.SlackEmergency && config.SlackChannel != "" {
 			// alert people via slack as well
 			message := fmt.Sprintf("ONCALL CHANGE: %s is now on duty (was %s).",
 				nowOncaller.Code,
 				todayOncaller.Code)
+			if name != "" {
+				message = fmt.Sprintf("[%s] %s", name, message)
+			}
 			err := doSlackNotify(message, config.SlackChannel)
 			if err != nil {
-				fmt.Printf("Error sending Slack notification: %s\n", err)
+				if err := failDay(now, "slack", err); err != nil {
+					return err
+				}
 			}
 			// and DM the victim too
 			err = doSlackDM(message, nowOncaller.Code)
 			if err != nil {
-				fmt.Printf("Error sending Slack notification: %s\n", err)
+				if err := failDay(now, "slack", err); err != nil {
+					return err
+				}
 			}
 		}
 	}
+	if !reminders {
+		return nil
+	}
 
 	// Send Slack notifications if it's called for. First to channel, then to the oncaller.
 	message := fmt.Sprintf("It's %s, and %s is currently on duty.",
-		time.Now().Local().Format("15:04"),
+		now.Format("15:04"),
 		nowOncaller.Code)
 	directMessage := fmt.Sprintf("Hello, %s! Just a reminder that you're on duty.",
 		nowOncaller.Code)
+	if name != "" {
+		message = fmt.Sprintf("[%s] %s", name, message)
+		directMessage = fmt.Sprintf("Hello, %s! Just a reminder that you're on duty for %s.",
+			nowOncaller.Code, name)
+	}
 	if *notifySlack && config.SlackKey != "" {
 		err := doSlackNotify(message, config.SlackChannel)
 		if err != nil {
-			fmt.Printf("Error sending Slack notification: %s\n", err)
+			if err := failDay(now, "slack", err); err != nil {
+				return err
+			}
 		}
 		// If there's a Slack user by that name, DM them as well.
 		err = doSlackDM(directMessage, nowOncaller.Code)
 		if err != nil {
-			fmt.Printf("Error sending Slack notification: %s\n", err)
+			if err := failDay(now, "slack", err); err != nil {
+				return err
+			}
 		}
 	}
 
 	if *notifySlack && nowOncaller.SlackID != "" {
 		err := doSlackNotify(message, nowOncaller.SlackID)
 		if err != nil {
-			fmt.Printf("Error sending Slack notification: %s\n", err)
+			if err := failDay(now, "slack", err); err != nil {
+				return err
+			}
 		}
 	}
 	// Finally, notify current (or next) victim if required.
@@ -302,12 +522,130 @@ func main() {
 	var notifyresult error
 	switch *notifyVictim {
 	case "today":
-		notifyresult = doNotify(oncall.Days[dateFormat(time.Now())].Victim, "today")
+		notifyresult = doNotify(nowOncaller, "today")
 	case "tomorrow":
-		notifyresult = doNotify(oncall.Days[dateFormat(time.Now().AddDate(0, 0, 1))].Victim, "tomorrow")
+		tomorrow, err := oncallAt(cal, now.AddDate(0, 0, 1))
+		if err != nil {
+			return err
+		}
+		notifyresult = doNotify(tomorrow.Victim, "tomorrow")
 	}
 	if notifyresult != nil {
-		fmt.Printf("Error sending mail: %s\n", notifyresult)
+		return failDay(now, "mail", notifyresult)
+	}
+	return nil
+}
+
+// fillRota writes days days of rota, starting at firstDate, for the
+// active rotation (or region).
+func fillRota(cal CalendarBackend, firstDate time.Time, daysToRotate int) error {
+	var lastOncall oncallPerson
+
+	// Load the existing rotation in advance (we'll need it all anyway)
+	if err := prefetchDays(cal, firstDate, daysToRotate); err != nil {
+		return err
+	}
+
+	// With incremental sync, skip the days nothing has changed for
+	from, ok := regenerateFrom(firstDate, daysToRotate)
+	if !ok {
+		if *flagVerbose {
+			fmt.Println("Nothing changed, leaving the rota as it is")
+		}
+		return nil
+	}
+	if dateFormat(from) > dateFormat(firstDate) && *flagVerbose {
+		fmt.Printf("Regenerating from %s\n", dateFormat(from))
+	}
+	for dateFormat(firstDate) < dateFormat(from) {
+		firstDate = firstDate.AddDate(0, 0, 1)
+		daysToRotate--
+	}
+
+	// get day-1 oncall to prime the rotation
+
+	if *lastOn != "" {
+		lastOncall = oncallersByCode[*lastOn]
+	} else if oncall.Days[dateFormat(firstDate.AddDate(0, 0, -1))].Victim.Code != "" {
+		lastOncall = oncall.Days[dateFormat(firstDate.AddDate(0, 0, -1))].Victim
+		if *flagDebug {
+			fmt.Printf("Yesterday's oncall (starting point) was: %s\n", lastOncall.Code)
+		}
+	} else {
+		lastOncall = oncallersByOrder[0]
+	}
+
+	if config.Scheduler == "fair" {
+		if err := rotateFair(cal, firstDate, daysToRotate); err != nil {
+			return err
+		}
+	} else {
+		// Work through the window a shift at a time (a shift is a single
+		// day unless ShiftLength says otherwise).
+		for x := 0; x < daysToRotate; {
+			day := firstDate.AddDate(0, 0, x)
+			length := shiftLength(day, daysToRotate-x)
+			var err error
+			lastOncall, err = rotateShift(cal, day, length, lastOncall, x == 0)
+			if err != nil {
+				return err
+			}
+			x += length
+		}
+	}
+
+	// Backups go in afterwards, as they follow the primary rota.
+	if config.BackupOncall {
+		for x := 0; x < daysToRotate; x++ {
+			if err := rotateBackup(cal, firstDate.AddDate(0, 0, x)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// prefetchDays loads the existing rota for the whole months covering days
+// days from firstDate, plus a day either side.
+func prefetchDays(cal CalendarBackend, firstDate time.Time, days int) error {
+	firstOfMonth, daysToFetch := getMonthRange(firstDate, days)
+
+	// One query per calendar for the lot (availability is needed for the
+	// same days, as restrictions count whole months).
+	start := firstOfMonth.AddDate(0, 0, -2)
+	end := firstOfMonth.AddDate(0, 0, daysToFetch+3)
+	for _, calendarID := range []string{config.OncallCalendar, config.AvailabilityCalendar} {
+		if err := loadRange(cal, calendarID, start, end); err != nil {
+			return err
+		}
 	}
 
+	if *flagDebug {
+		fmt.Printf("Prefetching %d days...", daysToFetch)
+	}
+	for x := -1; x <= daysToFetch+1; x++ {
+		day := firstOfMonth.AddDate(0, 0, x)
+		d, err := getOncallByDay(cal, day)
+		if err != nil {
+			return err
+		}
+		oncall.Days[dateFormat(day)] = d
+		reconcileDay(day, d)
+	}
+	if *flagDebug {
+		fmt.Printf("done\n")
+	}
+	return nil
+}
+
+// exportRota writes iCalendar feeds of the rota to dir under -export.dir,
+// if that's set.
+func exportRota(dir string) {
+	if *exportDir == "" {
+		return
+	}
+	err := writeICSFeeds(filepath.Join(*exportDir, dir), oncall.Days, config.Oncallers)
+	if err != nil {
+		fmt.Printf("Error writing iCalendar feeds: %s\n", err)
+	}
 }
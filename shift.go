@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Multi-day shifts start every ShiftLength days, counted from the first
+// HandoverWeekday after this date (which was a Monday).
+var shiftEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// isHandoverDay reports whether a new shift starts on day.
+func isHandoverDay(day time.Time) bool {
+	if config.ShiftLength <= 1 {
+		return true
+	}
+	anchor := shiftEpoch
+	if wd, ok := parseWeekday(config.HandoverWeekday); ok {
+		anchor = anchor.AddDate(0, 0, (int(wd)+6)%7)
+	}
+	date := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	n := int(date.Sub(anchor).Hours() / 24)
+	return n%config.ShiftLength == 0
+}
+
+// shiftLength returns the number of days from day up to (not including)
+// the next handover, but no more than remaining.
+func shiftLength(day time.Time, remaining int) int {
+	if config.ShiftLength <= 1 {
+		return 1
+	}
+	n := 1
+	for n < remaining && !isHandoverDay(day.AddDate(0, 0, n)) {
+		n++
+	}
+	return n
+}
+
+// rotateShift assigns oncallers to length days starting at first, and
+// returns the person the next shift should follow on from. For multi-day
+// shifts one person (the owner) takes the whole shift; on days they are
+// away or over their limits, the next available person covers for them.
+// If continuing is set we may have started mid-shift, and keep the owner
+// who started it. Days that can't be done are skipped (see failDay); the
+// error is only returned if the run should stop.
+func rotateShift(cal CalendarBackend, first time.Time, length int,
+	lastOncall oncallPerson, continuing bool) (oncallPerson, error) {
+
+	if config.ShiftLength <= 1 {
+		return rotateDay(cal, first, lastOncall)
+	}
+
+	var owner oncallPerson
+	if continuing && !isHandoverDay(first) {
+		owner = lastOncall
+		for n := 1; n < config.ShiftLength; n++ {
+			start := first.AddDate(0, 0, -n)
+			if !isHandoverDay(start) {
+				continue
+			}
+			if d, ok := oncall.Days[dateFormat(start)]; ok && d.Victim.Code != "" {
+				owner = d.Victim
+			}
+			break
+		}
+	} else {
+		var err error
+		owner, err = findShiftOwner(cal, first, length, lastOncall)
+		if err != nil {
+			return lastOncall, failDay(first, "calendar", err)
+		}
+	}
+
+	for x := 0; x < length; x++ {
+		day := first.AddDate(0, 0, x)
+		unavailable, err := checkAvailability(cal, day)
+		if err != nil {
+			if err := failDay(day, "calendar", err); err != nil {
+				return owner, err
+			}
+			continue
+		}
+
+		fixcheck := oncall.Days[dateFormat(day)]
+		if fixcheck.Fixed == true {
+			if *flagVerbose == true {
+				fmt.Printf("%s: %s # Fixed,Out: %s\n",
+					day.Format("Mon 2006-01-02"),
+					fixcheck.Victim.Code,
+					strings.Join(unavailable, ","))
+			}
+			continue
+		}
+
+		dayOncall := owner
+		note := ""
+		if owner.Code == oncallerShadow.Code || isListed(owner.Code, unavailable) {
+			dayOncall = findNextOncall(unavailable, owner, true)
+			note = fmt.Sprintf(",Covering: %s", owner.Code)
+		}
+		if *flagVerbose == true {
+			fmt.Printf("%s: %s # Out: %s%s%s\n",
+				day.Format("Mon 2006-01-02"),
+				dayOncall.Code,
+				strings.Join(unavailable, ","),
+				note,
+				describeBlocks(day))
+		}
+		if err := assignDay(cal, day, dayOncall); err != nil {
+			return owner, err
+		}
+	}
+	return owner, nil
+}
+
+// findShiftOwner picks the next person in the rotation who is around for
+// the whole shift, or failing that, for its first day.
+func findShiftOwner(cal CalendarBackend, first time.Time, length int,
+	lastOwner oncallPerson) (oncallPerson, error) {
+	awayAny := []string{}
+	var awayFirst []string
+	for x := 0; x < length; x++ {
+		day := first.AddDate(0, 0, x)
+		if oncall.Days[dateFormat(day)].Fixed {
+			continue
+		}
+		away, err := getAwayList(cal, day)
+		if err != nil {
+			return oncallPerson{}, err
+		}
+		if awayFirst == nil {
+			awayFirst = away
+		}
+		awayAny = append(awayAny, away...)
+	}
+	owner := findNextOncall(awayAny, lastOwner, true)
+	if owner.Code == oncallerShadow.Code {
+		owner = findNextOncall(awayFirst, lastOwner, true)
+	}
+	if *flagDebug {
+		fmt.Printf("Shift from %s (%d days) goes to %s\n", dateFormat(first), length, owner.Code)
+	}
+	return owner, nil
+}
+
+// rotateDay does a single day of the classic day-by-day rotation, and
+// returns whoever ended up oncall (or should have).
+func rotateDay(cal CalendarBackend, day time.Time, lastOncall oncallPerson) (oncallPerson, error) {
+	workday := isWorkday(day)
+
+	unavailable, err := checkAvailability(cal, day)
+	if err != nil {
+		return lastOncall, failDay(day, "calendar", err)
+	}
+
+	// check to see if there's a fixed entry - if so, skip from here
+	fixcheck := oncall.Days[dateFormat(day)]
+	if fixcheck.Fixed == true {
+		if *flagVerbose == true {
+			fmt.Printf("%s: %s # Fixed,Out: %s\n",
+				day.Format("Mon 2006-01-02"),
+				fixcheck.Victim.Code,
+				strings.Join(unavailable, ","))
+		}
+		return fixcheck.Victim, nil
+	}
+
+	dayOncall := findNextOncall(unavailable, lastOncall, workday)
+	note := ""
+	if workday {
+		if preferred, ok := preferredOncall(unavailable, lastOncall, dayOncall, day); ok {
+			note = fmt.Sprintf(",Preferred over: %s", dayOncall.Code)
+			dayOncall = preferred
+		}
+	}
+	if *flagVerbose == true {
+		fmt.Printf("%s: %s # Out: %s%s%s\n",
+			day.Format("Mon 2006-01-02"),
+			dayOncall.Code,
+			strings.Join(unavailable, ","),
+			note,
+			describeBlocks(day))
+	}
+	return dayOncall, assignDay(cal, day, dayOncall)
+}
+
+// assignDay writes a day's oncaller to the calendar (and OpsGenie). If
+// that fails, it's noted with failDay, and OpsGenie is left alone.
+func assignDay(cal CalendarBackend, day time.Time, victim oncallPerson) error {
+	previous := oncallPerson{}
+	if d, ok := oncall.Days[dateFormat(day)]; ok {
+		previous = d.Victim
+	}
+	reason := overrideReason(cal, day, previous, victim)
+	if err := setOncallByDay(cal, day, victim, false); err != nil {
+		return failDay(day, "calendar", err)
+	}
+	if d, ok := oncall.Days[dateFormat(day)]; ok {
+		d.Victim = victim
+		d.Fixed = false
+	} else {
+		oncall.Days[dateFormat(day)] = &oncallDay{Victim: victim}
+	}
+	// FIXME(mpk): Handle changing today's oncall via OpsGenie properly
+	// Call out to opsgenie here
+	if config.OpsGenie.APIKey != "" {
+		if err := setOpsgenieByDay(day, victim.Email, reason); err != nil {
+			return failDay(day, "opsgenie", err)
+		}
+	}
+	return nil
+}
+
+func isListed(code string, list []string) bool {
+	for _, c := range list {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
@@ -15,6 +15,10 @@ func getSlackParams() slack.PostMessageParameters {
 }
 
 func doSlackDM(message string, destination string) error {
+	if activePlan != nil {
+		planNotification(&planOp{Kind: "slack-dm", Destination: destination, Message: message})
+		return nil
+	}
 	var destID string
 	slackAPI := slack.New(config.SlackKey)
 	userList, err := slackAPI.GetUsers()
@@ -47,6 +51,10 @@ func doSlackDM(message string, destination string) error {
 }
 
 func doSlackNotify(message string, destination string) error {
+	if activePlan != nil {
+		planNotification(&planOp{Kind: "slack", Destination: destination, Message: message})
+		return nil
+	}
 
 	slackAPI := slack.New(config.SlackKey)
 	channel := config.SlackChannel
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// The state file (StateFile) is a local record of the rota, kept so that
+// history survives people editing or deleting calendar events. For every
+// rotation (and region) it holds each day's assignment, whether it was
+// fixed, who it replaced and when it last changed. The calendar still has
+// the final say: whatever is found there is copied into the state, but
+// days that have gone missing from the calendar keep their recorded
+// oncaller, which then counts towards the limits and fairness.
+type stateDay struct {
+	Victim   string    `json:"victim"`
+	Fixed    bool      `json:"fixed,omitempty"`
+	Backup   string    `json:"backup,omitempty"`
+	Replaced string    `json:"replaced,omitempty"`
+	Changed  time.Time `json:"changed"`
+	Source   string    `json:"source"` // "rotator" or "calendar"
+}
+
+type rotaState struct {
+	Days map[string]*stateDay `json:"days"`
+}
+
+type stateStore struct {
+	Rotations map[string]*rotaState `json:"rotations"`
+	loaded    bool
+	dirty     bool
+}
+
+var state stateStore
+
+// The rotation being worked on, as named in the config ("" if unnamed).
+var activeRotation string
+
+// stateKey identifies the active rotation (and region) in the state file.
+func stateKey() string {
+	if activeRegion != nil {
+		return activeRotation + "/" + activeRegion.Name
+	}
+	return activeRotation
+}
+
+func loadState() error {
+	if state.loaded || config.StateFile == "" {
+		return nil
+	}
+	state.loaded = true
+	state.Rotations = make(map[string]*rotaState)
+	data, err := ioutil.ReadFile(config.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("%s: %s", config.StateFile, err)
+	}
+	if state.Rotations == nil {
+		state.Rotations = make(map[string]*rotaState)
+	}
+	return nil
+}
+
+// saveState writes the state file back if anything changed (but not on
+// a dry run, or when only making a plan).
+func saveState() error {
+	if !state.dirty || *flagDryRun || activePlan != nil || config.StateFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(&state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(config.StateFile, append(data, '\n')); err != nil {
+		return err
+	}
+	state.dirty = false
+	return nil
+}
+
+// stateDays returns the recorded days of the active rotation, or nil if
+// there's no state file.
+func stateDays() map[string]*stateDay {
+	if !state.loaded {
+		return nil
+	}
+	r, ok := state.Rotations[stateKey()]
+	if !ok {
+		r = &rotaState{Days: make(map[string]*stateDay)}
+		state.Rotations[stateKey()] = r
+	}
+	return r.Days
+}
+
+// recordOncall notes that victim is now oncall on day (by our doing).
+func recordOncall(day time.Time, victim oncallPerson, fixed bool) {
+	days := stateDays()
+	if days == nil {
+		return
+	}
+	sd, ok := days[dateFormat(day)]
+	if !ok {
+		sd = &stateDay{}
+		days[dateFormat(day)] = sd
+	}
+	if sd.Victim == victim.Code && sd.Fixed == fixed {
+		return
+	}
+	if sd.Victim != victim.Code {
+		sd.Replaced = sd.Victim
+	}
+	sd.Victim = victim.Code
+	sd.Fixed = fixed
+	sd.Changed = time.Now()
+	sd.Source = "rotator"
+	state.dirty = true
+}
+
+// recordBackup notes the day's backup oncaller.
+func recordBackup(day time.Time, backup oncallPerson) {
+	days := stateDays()
+	if days == nil {
+		return
+	}
+	sd, ok := days[dateFormat(day)]
+	if !ok {
+		sd = &stateDay{Changed: time.Now(), Source: "rotator"}
+		days[dateFormat(day)] = sd
+	}
+	if sd.Backup != backup.Code {
+		sd.Backup = backup.Code
+		state.dirty = true
+	}
+}
+
+// reconcileDay brings the state in line with what the calendar says about
+// day. Changes made by hand are recorded as such; days missing from the
+// calendar are left as they were.
+func reconcileDay(day time.Time, d *oncallDay) {
+	days := stateDays()
+	if days == nil || d == nil || d.Victim.Code == "" {
+		return
+	}
+	sd, ok := days[dateFormat(day)]
+	if !ok {
+		sd = &stateDay{}
+		days[dateFormat(day)] = sd
+	}
+	if sd.Victim == d.Victim.Code && sd.Fixed == d.Fixed && sd.Backup == d.Backup.Code {
+		return
+	}
+	if sd.Victim != d.Victim.Code {
+		sd.Replaced = sd.Victim
+	}
+	sd.Victim = d.Victim.Code
+	sd.Fixed = d.Fixed
+	sd.Backup = d.Backup.Code
+	sd.Changed = time.Now()
+	sd.Source = "calendar"
+	state.dirty = true
+}
+
+// pastOncall returns who was oncall on day according to the calendar, or
+// failing that the state file. The state only stands in for days gone by:
+// anything later is up to the rota generator.
+func pastOncall(day time.Time) oncallPerson {
+	if d, ok := oncall.Days[dateFormat(day)]; ok && d != nil && d.Victim.Code != "" {
+		return d.Victim
+	}
+	if dateFormat(day) >= dateFormat(rotaNow()) {
+		return oncallPerson{}
+	}
+	if sd, ok := stateDays()[dateFormat(day)]; ok {
+		if person, ok := oncallersByCode[sd.Victim]; ok {
+			return person
+		}
+	}
+	return oncallPerson{}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// swapCommand handles "swap DATE1 CODE1 DATE2 CODE2", where CODE1 is oncall
+// on DATE1 and CODE2 on DATE2: afterwards it's the other way round. Both
+// days are marked fixed so the rota generator leaves them alone. If the
+// second day can't be written, the first is put back as it was.
+func swapCommand(cal CalendarBackend, args []string) error {
+	if len(args) != 4 {
+		return errors.New("usage: swap DATE1 CODE1 DATE2 CODE2")
+	}
+	if len(config.Regions) > 0 {
+		return errors.New("not supported for follow-the-sun rotations")
+	}
+
+	days := make([]time.Time, 2)
+	people := make([]oncallPerson, 2)
+	for x := 0; x < 2; x++ {
+		day, err := parseDate(args[2*x])
+		if err != nil {
+			return fmt.Errorf("bad date %q (want YYYY-MM-DD)", args[2*x])
+		}
+		person, ok := oncallersByCode[strings.ToLower(args[2*x+1])]
+		if !ok {
+			return fmt.Errorf("unknown oncaller %q", args[2*x+1])
+		}
+		days[x] = day
+		people[x] = person
+	}
+	if dateFormat(days[0]) == dateFormat(days[1]) || people[0].Code == people[1].Code {
+		return errors.New("need two different days and two different people")
+	}
+
+	for x := 0; x < 2; x++ {
+		if err := prefetchDays(cal, days[x], 0); err != nil {
+			return err
+		}
+	}
+	for x := 0; x < 2; x++ {
+		d := oncall.Days[dateFormat(days[x])]
+		if d.Victim.Code != people[x].Code {
+			return fmt.Errorf("%s is oncall on %s, not %s",
+				d.Victim.Code, dateFormat(days[x]), people[x].Code)
+		}
+	}
+
+	// Each person takes the other's day.
+	if err := checkSwap(cal, days, []oncallPerson{people[1], people[0]}); err != nil {
+		return err
+	}
+	first := *oncall.Days[dateFormat(days[0])]
+	for x := 0; x < 2; x++ {
+		day, victim := days[x], people[1-x]
+		if err := setOncallByDay(cal, day, victim, true); err != nil {
+			err = fmt.Errorf("couldn't write %s to the calendar: %s", dateFormat(day), err)
+			if x == 1 {
+				// Don't leave one person with both days.
+				if undo := unswapDay(cal, days[0], first); undo != nil {
+					err = fmt.Errorf("%s, and couldn't put %s back on %s: %s", err,
+						first.Victim.Code, dateFormat(days[0]), undo)
+				}
+			}
+			return err
+		}
+		d := oncall.Days[dateFormat(day)]
+		d.Victim = victim
+		d.Fixed = true
+	}
+	for x := 0; x < 2; x++ {
+		day, victim := days[x], people[1-x]
+		if config.OpsGenie.APIKey != "" {
+			if err := setOpsgenieByDay(day, victim.Email, "swap"); err != nil {
+				if err := failDay(day, "opsgenie", err); err != nil {
+					return err
+				}
+			}
+		}
+		fmt.Printf("%s: %s (was %s)\n", day.Format("Mon 2006-01-02"), victim.Code, people[x].Code)
+	}
+
+	if *flagDryRun {
+		return nil
+	}
+	for x := 0; x < 2; x++ {
+		if err := notifySwap(people[x], people[1-x], days[x], days[1-x]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unswapDay puts day back the way it was before the swap.
+func unswapDay(cal CalendarBackend, day time.Time, was oncallDay) error {
+	d := oncall.Days[dateFormat(day)]
+	// as it's fixed now, setOncallByDay would otherwise leave it be
+	d.Fixed = was.Fixed
+	if err := setOncallByDay(cal, day, was.Victim, was.Fixed); err != nil {
+		return err
+	}
+	*d = was
+	return nil
+}
+
+// checkSwap makes sure people[x] can do days[x]. Both days are taken out
+// of the rota while checking, so that the day someone gives up makes room
+// for the one they take on within their monthly limits.
+func checkSwap(cal CalendarBackend, days []time.Time, people []oncallPerson) error {
+	saved := make([]oncallDay, len(days))
+	for x, day := range days {
+		d := oncall.Days[dateFormat(day)]
+		saved[x] = *d
+		d.Victim = oncallPerson{}
+	}
+	defer func() {
+		for x, day := range days {
+			*oncall.Days[dateFormat(day)] = saved[x]
+		}
+		restrictions = restrictionSet{}
+	}()
+
+	for x, day := range days {
+		// count everyone's load afresh
+		restrictions = restrictionSet{}
+		unavailable, err := checkAvailability(cal, day)
+		if err != nil {
+			return err
+		}
+		if isListed(strings.ToLower(people[x].Code), unavailable) {
+			reason := personalBlock(people[x], day)
+			if reason == "" {
+				reason = "away or over their limits"
+			}
+			return fmt.Errorf("%s can't do %s (%s)", people[x].Code, dateFormat(day), reason)
+		}
+	}
+	return nil
+}
+
+// notifySwap tells victim about the swap by mail and Slack. Failures are
+// noted with failDay, and only returned under -on_error=stop.
+func notifySwap(victim oncallPerson, other oncallPerson, gave time.Time, took time.Time) error {
+	err := doSwapNotify(victim, other, gave, took)
+	if err != nil {
+		if err := failDay(time.Time{}, "mail", err); err != nil {
+			return err
+		}
+	}
+	if config.SlackKey == "" {
+		return nil
+	}
+	message := fmt.Sprintf("ONCALL SWAP: %s is on duty %s instead of %s (%s takes %s).",
+		victim.Code, took.Format("Mon 2 Jan"), gave.Format("Mon 2 Jan"),
+		other.Code, gave.Format("Mon 2 Jan"))
+	err = doSlackDM(message, victim.Code)
+	if err != nil {
+		return failDay(time.Time{}, "slack", err)
+	}
+	return nil
+}
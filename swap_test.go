@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// failingDay is a calendar that won't take any writes for one day.
+type failingDay struct {
+	*fakeBackend
+	day string
+}
+
+func (f *failingDay) InsertEvent(calendarID string, event *calendarEvent) error {
+	if dateFormat(event.Start) == f.day {
+		return errors.New("quota exceeded")
+	}
+	return f.fakeBackend.InsertEvent(calendarID, event)
+}
+
+func (f *failingDay) UpdateEvent(calendarID string, event *calendarEvent) error {
+	if dateFormat(event.Start) == f.day {
+		return errors.New("quota exceeded")
+	}
+	return f.fakeBackend.UpdateEvent(calendarID, event)
+}
+
+func TestSwapSecondDayFails(t *testing.T) {
+	f := setupTest(t, "Europe/Vienna")
+	f.add("oncall", allDayEvent("aa onduty", "2026-11-03", "2026-11-04"))
+	f.add("oncall", allDayEvent("bob onduty", "2026-11-10", "2026-11-11"))
+	cal := &failingDay{f, "2026-11-10"}
+
+	err := swapCommand(cal, []string{"2026-11-03", "aa", "2026-11-10", "bob"})
+	if err == nil || !strings.Contains(err.Error(), "2026-11-10") {
+		t.Fatalf("got error %v", err)
+	}
+	want := "2026-11-03 aa onduty,2026-11-10 bob onduty"
+	if got := strings.Join(f.summaries("oncall"), ","); got != want {
+		t.Errorf("calendar: %s, want %s", got, want)
+	}
+	if d := oncall.Days["2026-11-03"]; d.Victim.Code != "aa" || d.Fixed {
+		t.Errorf("2026-11-03: %s, fixed %v", d.Victim.Code, d.Fixed)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// With SyncCache set, calendars that support it (Google) are synced
+// incrementally: the first run loads everything from a few months back and
+// saves it, with a sync token, to the cache file. Later runs only ask for
+// what changed since, and only regenerate the rota from the first affected
+// day on (see regenerateFrom). An expired token (410 Gone) means a full
+// sync again. The cache isn't saved after a run with failures, so that the
+// next run sees the same changes again and has another go at them.
+type syncState struct {
+	Token  string           `json:"token"`
+	From   time.Time        `json:"from"`
+	Events []*calendarEvent `json:"events"`
+	cached *cachedCalendar
+}
+
+// Settings holds a checksum of the settings each rotation was last
+// generated with (see rotaSettingsHash), by state key.
+type syncCacheFile struct {
+	Calendars map[string]*syncState `json:"calendars"`
+	Settings  map[string]string     `json:"settings,omitempty"`
+	loaded    bool
+}
+
+var syncCache syncCacheFile
+
+// eventSyncer is implemented by backends that can list what changed in a
+// calendar since a sync token (or, without one, everything from from on),
+// returning the changed events, the IDs of deleted ones and the next token.
+type eventSyncer interface {
+	SyncEvents(calendarID string, from time.Time, token string) ([]*calendarEvent, []string, string, error)
+}
+
+var errSyncExpired = errors.New("sync token expired")
+
+// A full sync reaches this far back before the first day needed, to take
+// in the fair scheduler's history.
+const syncHistoryDays = 120
+
+// How far ahead a synced calendar counts as loaded.
+const syncYears = 10
+
+// The days touched by changes found by this run's incremental syncs, by
+// calendar. Calendars that had to be loaded in full aren't in here.
+var syncChanges = make(map[string]map[string]bool)
+
+func loadSyncCache() error {
+	if syncCache.loaded {
+		return nil
+	}
+	syncCache.loaded = true
+	syncCache.Calendars = make(map[string]*syncState)
+	data, err := ioutil.ReadFile(config.SyncCache)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &syncCache); err != nil {
+		return fmt.Errorf("%s: %s", config.SyncCache, err)
+	}
+	if syncCache.Calendars == nil {
+		syncCache.Calendars = make(map[string]*syncState)
+	}
+	return nil
+}
+
+// rotaSettingsHash is a checksum of the active rotation's settings that
+// decide who gets which day. When they change, a day nothing in the
+// calendars says anything new about may still need a different oncaller.
+func rotaSettingsHash() string {
+	data, _ := json.Marshal(struct {
+		Oncallers           []oncallPerson
+		MaxDaysPerMonth     int
+		MaxWeekendsPerMonth int
+		ShadowOncaller      string
+		ShiftLength         int
+		HandoverWeekday     string
+		BackupOncall        bool
+		Scheduler           string
+		AustrianHolidays    *bool
+		HolidayFiles        []string
+		HolidayRegions      map[string]string
+		AwayWords           []string
+	}{config.Oncallers, config.MaxDaysPerMonth, config.MaxWeekendsPerMonth, config.ShadowOncaller,
+		config.ShiftLength, config.HandoverWeekday, config.BackupOncall, config.Scheduler,
+		config.AustrianHolidays, config.HolidayFiles, config.HolidayRegions, config.AwayWords})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// saveSyncCache writes back the synced calendars, as they are now (but not
+// on a dry run, or when making a plan, when they'd include changes that
+// weren't really made, nor when something went wrong, when the changes
+// found haven't all been dealt with).
+func saveSyncCache() error {
+	if !syncCache.loaded || *flagDryRun || activePlan != nil || config.SyncCache == "" {
+		return nil
+	}
+	if len(failures) > 0 {
+		if *flagVerbose {
+			fmt.Println("Not saving the sync cache, the next run will look at the same changes again")
+		}
+		return nil
+	}
+	for _, st := range syncCache.Calendars {
+		if st.cached == nil {
+			continue
+		}
+		st.Events = []*calendarEvent{}
+		for _, e := range st.cached.byID {
+			st.Events = append(st.Events, e)
+		}
+	}
+	data, err := json.Marshal(&syncCache)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(config.SyncCache, append(data, '\n'))
+}
+
+// syncCalendar loads calendarID into the cache from the sync cache plus
+// whatever changed since, or failing that in full from a while before
+// start on.
+func (c *cacheBackend) syncCalendar(s eventSyncer, calendarID string, start time.Time) error {
+	if err := loadSyncCache(); err != nil {
+		return err
+	}
+	cc := newCachedCalendar()
+	st := syncCache.Calendars[calendarID]
+	incremental := st != nil && st.Token != "" && !st.From.After(start)
+	if incremental {
+		changed, deleted, token, err := s.SyncEvents(calendarID, time.Time{}, st.Token)
+		if err == errSyncExpired {
+			if *flagVerbose {
+				fmt.Printf("Sync token for %s expired, syncing in full\n", calendarID)
+			}
+			incremental = false
+		} else if err != nil {
+			return err
+		} else {
+			cc.ranges = append(cc.ranges, [2]time.Time{st.From, st.From.AddDate(syncYears, 0, 0)})
+			for _, e := range st.Events {
+				cc.add(e)
+			}
+			touched := make(map[string]bool)
+			for _, id := range deleted {
+				if old, ok := cc.byID[id]; ok {
+					touchDays(touched, old)
+					cc.remove(old)
+				}
+			}
+			for _, e := range changed {
+				old, ok := cc.byID[e.ID]
+				if ok && sameEvent(old, e) {
+					// most likely one we wrote ourselves
+					continue
+				}
+				if ok {
+					touchDays(touched, old)
+				}
+				touchDays(touched, e)
+				cc.add(e)
+			}
+			syncChanges[calendarID] = touched
+			st.Token = token
+			if *flagDebug {
+				fmt.Printf("Synced %s: %d changed, %d deleted\n", calendarID, len(changed), len(deleted))
+			}
+		}
+	}
+	if !incremental {
+		from := dayStart(start.AddDate(0, 0, -syncHistoryDays))
+		events, _, token, err := s.SyncEvents(calendarID, from, "")
+		if err != nil {
+			return err
+		}
+		st = &syncState{Token: token, From: from}
+		cc.ranges = append(cc.ranges, [2]time.Time{from, from.AddDate(syncYears, 0, 0)})
+		for _, e := range events {
+			cc.add(e)
+		}
+		delete(syncChanges, calendarID)
+		if *flagDebug {
+			fmt.Printf("Synced %s in full: %d events\n", calendarID, len(events))
+		}
+	}
+	st.cached = cc
+	syncCache.Calendars[calendarID] = st
+	c.calendars[calendarID] = cc
+	return nil
+}
+
+// touchDays marks the (rota) days e takes up.
+func touchDays(touched map[string]bool, e *calendarEvent) {
+	first := e.Start.In(rotaLocation)
+	if e.AllDay {
+		first = e.Start
+	}
+	touched[dateFormat(first)] = true
+	for day := dayStart(first).AddDate(0, 0, 1); day.Before(e.End); day = day.AddDate(0, 0, 1) {
+		touched[dateFormat(day)] = true
+	}
+}
+
+func sameEvent(a *calendarEvent, b *calendarEvent) bool {
+	if a.Summary != b.Summary || a.AllDay != b.AllDay || !a.Start.Equal(b.Start) ||
+		!a.End.Equal(b.End) || len(a.Attendees) != len(b.Attendees) {
+		return false
+	}
+	for i := range a.Attendees {
+		if a.Attendees[i] != b.Attendees[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// regenerateFrom works out where to start regenerating days days from
+// firstDate, given what the incremental sync found changed: at the first
+// day nobody is down for, or the first of the month of the first change
+// (monthly limits take in the whole month), whichever comes first. It
+// returns false if nothing needs doing at all. Without incremental sync of
+// both calendars, where the whole window matters (the fair scheduler,
+// -unrestrict, -laston, regions), or when the rotation's settings have
+// changed since the last run, it's always firstDate.
+func regenerateFrom(firstDate time.Time, days int) (time.Time, bool) {
+	if config.SyncCache == "" || config.Scheduler == "fair" || *flagUnrestrict ||
+		*lastOn != "" || activeRegion != nil || !syncCache.loaded {
+		return firstDate, true
+	}
+	if syncCache.Settings == nil {
+		syncCache.Settings = make(map[string]string)
+	}
+	hash := rotaSettingsHash()
+	if syncCache.Settings[stateKey()] != hash {
+		syncCache.Settings[stateKey()] = hash
+		if *flagVerbose {
+			fmt.Println("Settings changed since the last run, regenerating everything")
+		}
+		return firstDate, true
+	}
+	first := dateFormat(firstDate)
+	last := dateFormat(firstDate.AddDate(0, 0, days-1))
+	from := ""
+	for _, calendarID := range []string{config.OncallCalendar, config.AvailabilityCalendar} {
+		touched, ok := syncChanges[calendarID]
+		if !ok {
+			return firstDate, true
+		}
+		for day := range touched {
+			if day > last || day[:7] < first[:7] {
+				continue
+			}
+			start := day[:7] + "-01"
+			if start < first {
+				start = first
+			}
+			if from == "" || start < from {
+				from = start
+			}
+		}
+	}
+	for x := 0; x < days; x++ {
+		day := dateFormat(firstDate.AddDate(0, 0, x))
+		if from != "" && day >= from {
+			break
+		}
+		d, ok := oncall.Days[day]
+		if !ok || d.Victim.Code == "" || (config.BackupOncall && d.Backup.Code == "") {
+			from = day
+			break
+		}
+	}
+	if from == "" {
+		return firstDate, false
+	}
+	day, _ := parseDate(from)
+	return day, true
+}
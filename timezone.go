@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Rota days are calendar dates in the rota's time zone (TimeZone, or the
+// local time zone if that's unset). A day runs from midnight to midnight
+// there, which around DST changes is 23 or 25 hours rather than 24, so
+// days are always stepped with AddDate and pinned down with dayStart.
+var rotaLocation = time.Local
+
+// Default handover times for the OpsGenie overrides.
+var defaultWeekdayHandover = "08:00"
+var defaultWeekendHandover = "10:00"
+
+// loadTimeZone sets up rotaLocation for the active rotation and checks
+// the handover times while it's at it.
+func loadTimeZone() error {
+	rotaLocation = time.Local
+	if config.TimeZone != "" {
+		loc, err := time.LoadLocation(config.TimeZone)
+		if err != nil {
+			return err
+		}
+		rotaLocation = loc
+	}
+	for _, clock := range []string{config.HandoverTime, config.WeekdayHandover, config.WeekendHandover} {
+		if clock == "" {
+			continue
+		}
+		if _, err := time.Parse("15:04", clock); err != nil {
+			return fmt.Errorf("bad handover time %q (want HH:MM)", clock)
+		}
+	}
+	return nil
+}
+
+// rotaNow is the current time in the rota's time zone.
+func rotaNow() time.Time {
+	return time.Now().In(rotaLocation)
+}
+
+// parseDate reads a YYYY-MM-DD date as midnight in the rota's time zone.
+func parseDate(date string) (time.Time, error) {
+	return time.ParseInLocation("2006-01-02", date, rotaLocation)
+}
+
+// dayStart returns the midnight that starts day's date in the rota's
+// time zone.
+func dayStart(day time.Time) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, rotaLocation)
+}
+
+// atClock returns the time clock (HH:MM) on day's date in the rota's time
+// zone. Times skipped by a DST change come out an hour later.
+func atClock(day time.Time, clock string) time.Time {
+	return atClockIn(day, clock, rotaLocation)
+}
+
+// atClockIn is atClock for another time zone.
+func atClockIn(day time.Time, clock string, loc *time.Location) time.Time {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, loc)
+	}
+	at := time.Date(day.Year(), day.Month(), day.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+	// time.Date may resolve a clock time that doesn't exist to either
+	// side of the gap; make it the later one.
+	if skipped := (t.Hour()-at.Hour())*60 + t.Minute() - at.Minute(); skipped > 0 {
+		at = at.Add(time.Duration(skipped) * time.Minute)
+	}
+	return at
+}
+
+// handoverClock is when the OpsGenie override for day starts.
+func handoverClock(day time.Time) string {
+	if config.HandoverTime != "" {
+		return config.HandoverTime
+	}
+	if isWeekend(day) {
+		if config.WeekendHandover != "" {
+			return config.WeekendHandover
+		}
+		return defaultWeekendHandover
+	}
+	if config.WeekdayHandover != "" {
+		return config.WeekdayHandover
+	}
+	return defaultWeekdayHandover
+}
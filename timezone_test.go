@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// The DST weekends of 2026: Europe changes on the last Sundays of March
+// and October, the US on the second Sunday of March and the first of
+// November.
+var dstDays = []struct {
+	tz      string
+	date    string
+	hours   int    // length of the day
+	start   string // its midnight
+	weekend string // 10:00 (the weekend handover) that day
+}{
+	{"Europe/Vienna", "2026-03-28", 24, "2026-03-28T00:00:00+01:00", "2026-03-28T10:00:00+01:00"},
+	{"Europe/Vienna", "2026-03-29", 23, "2026-03-29T00:00:00+01:00", "2026-03-29T10:00:00+02:00"},
+	{"Europe/Vienna", "2026-10-24", 24, "2026-10-24T00:00:00+02:00", "2026-10-24T10:00:00+02:00"},
+	{"Europe/Vienna", "2026-10-25", 25, "2026-10-25T00:00:00+02:00", "2026-10-25T10:00:00+01:00"},
+	{"America/New_York", "2026-03-07", 24, "2026-03-07T00:00:00-05:00", "2026-03-07T10:00:00-05:00"},
+	{"America/New_York", "2026-03-08", 23, "2026-03-08T00:00:00-05:00", "2026-03-08T10:00:00-04:00"},
+	{"America/New_York", "2026-10-31", 24, "2026-10-31T00:00:00-04:00", "2026-10-31T10:00:00-04:00"},
+	{"America/New_York", "2026-11-01", 25, "2026-11-01T00:00:00-04:00", "2026-11-01T10:00:00-05:00"},
+}
+
+func TestDSTDays(t *testing.T) {
+	for _, tc := range dstDays {
+		setupTest(t, tc.tz)
+		day, err := parseDate(tc.date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// any time of the day will do
+		day = day.Add(13 * time.Hour)
+
+		if got := dayStart(day).Format(ogTimeString); got != tc.start {
+			t.Errorf("%s %s: starts %s, want %s", tc.tz, tc.date, got, tc.start)
+		}
+		if got := dayStart(day.AddDate(0, 0, 1)).Sub(dayStart(day)); got != time.Duration(tc.hours)*time.Hour {
+			t.Errorf("%s %s: %s long, want %dh", tc.tz, tc.date, got, tc.hours)
+		}
+		if got := handoverClock(day); got != "10:00" {
+			t.Errorf("%s %s: handover at %s, want 10:00", tc.tz, tc.date, got)
+		}
+		if got := atClock(day, handoverClock(day)).Format(ogTimeString); got != tc.weekend {
+			t.Errorf("%s %s: handover %s, want %s", tc.tz, tc.date, got, tc.weekend)
+		}
+	}
+}
+
+func TestDSTGap(t *testing.T) {
+	for _, tc := range []struct {
+		tz   string
+		date string
+		want string
+	}{
+		{"Europe/Vienna", "2026-03-29", "2026-03-29T03:30:00+02:00"},
+		{"America/New_York", "2026-03-08", "2026-03-08T03:30:00-04:00"},
+	} {
+		setupTest(t, tc.tz)
+		day, _ := parseDate(tc.date)
+		// 02:30 doesn't happen that night
+		if got := atClock(day, "02:30").Format(ogTimeString); got != tc.want {
+			t.Errorf("%s %s 02:30: got %s, want %s", tc.tz, tc.date, got, tc.want)
+		}
+	}
+}
+
+func TestDSTHandoverTime(t *testing.T) {
+	for _, tc := range []struct {
+		tz    string
+		date  string
+		hours int // from this handover to the next
+	}{
+		{"Europe/Vienna", "2026-03-28", 23},
+		{"Europe/Vienna", "2026-03-29", 24},
+		{"Europe/Vienna", "2026-10-24", 25},
+		{"America/New_York", "2026-03-07", 23},
+		{"America/New_York", "2026-10-31", 25},
+		{"America/New_York", "2026-11-01", 24},
+	} {
+		setupTest(t, tc.tz)
+		baseConfig.HandoverTime = "09:00"
+		useRotation(rotationConfig{})
+		day, _ := parseDate(tc.date)
+		next := day.AddDate(0, 0, 1)
+		if handoverClock(day) != "09:00" || handoverClock(next) != "09:00" {
+			t.Fatalf("handover at %s, want 09:00", handoverClock(day))
+		}
+		start, end := atClock(day, handoverClock(day)), atClock(next, handoverClock(next))
+		if got := end.Sub(start); got != time.Duration(tc.hours)*time.Hour {
+			t.Errorf("%s %s: shift %s long, want %dh", tc.tz, tc.date, got, tc.hours)
+		}
+		if start.In(rotaLocation).Hour() != 9 || end.In(rotaLocation).Hour() != 9 {
+			t.Errorf("%s %s: shift %s to %s", tc.tz, tc.date, start, end)
+		}
+	}
+}
+
+func TestDSTMonthRange(t *testing.T) {
+	for _, tc := range []struct {
+		tz    string
+		date  string
+		days  int
+		first string
+		count int
+	}{
+		{"Europe/Vienna", "2026-03-29", 10, "2026-03-01T00:00:00+01:00", 60},
+		{"Europe/Vienna", "2026-10-25", 10, "2026-10-01T00:00:00+02:00", 60},
+		{"America/New_York", "2026-03-08", 0, "2026-03-01T00:00:00-05:00", 30},
+		{"America/New_York", "2026-11-01", 0, "2026-11-01T00:00:00-04:00", 29},
+	} {
+		setupTest(t, tc.tz)
+		day, _ := parseDate(tc.date)
+		first, count := getMonthRange(day, tc.days)
+		if first.Format(ogTimeString) != tc.first || count != tc.count {
+			t.Errorf("%s %s+%d: %s and %d days, want %s and %d", tc.tz, tc.date, tc.days,
+				first.Format(ogTimeString), count, tc.first, tc.count)
+		}
+	}
+}
+
+// ogOverrideServer has no overrides yet, and keeps the ones created.
+type ogOverrideServer struct {
+	created []ogOverride
+}
+
+func (s *ogOverrideServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		http.NotFound(w, r)
+	case "POST":
+		var o ogOverride
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &o)
+		s.created = append(s.created, o)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestDSTOverrides(t *testing.T) {
+	og := &ogOverrideServer{}
+	srv := httptest.NewServer(og)
+	defer srv.Close()
+	saved := ogURLPrefix
+	ogURLPrefix = srv.URL
+	defer func() { ogURLPrefix = saved }()
+
+	for _, tc := range []struct {
+		tz       string
+		date     string
+		handover string
+		start    string
+		end      string
+	}{
+		// until midnight
+		{"Europe/Vienna", "2026-03-29", "", "2026-03-29T10:00:00+02:00", "2026-03-30T00:00:00+02:00"},
+		{"Europe/Vienna", "2026-10-25", "", "2026-10-25T10:00:00+01:00", "2026-10-26T00:00:00+01:00"},
+		{"America/New_York", "2026-03-08", "", "2026-03-08T10:00:00-04:00", "2026-03-09T00:00:00-04:00"},
+		{"America/New_York", "2026-11-01", "", "2026-11-01T10:00:00-05:00", "2026-11-02T00:00:00-05:00"},
+		// from one handover to the next, across the change
+		{"Europe/Vienna", "2026-03-28", "09:00", "2026-03-28T09:00:00+01:00", "2026-03-29T09:00:00+02:00"},
+		{"Europe/Vienna", "2026-10-24", "09:00", "2026-10-24T09:00:00+02:00", "2026-10-25T09:00:00+01:00"},
+		{"America/New_York", "2026-03-07", "09:00", "2026-03-07T09:00:00-05:00", "2026-03-08T09:00:00-04:00"},
+		{"America/New_York", "2026-10-31", "09:00", "2026-10-31T09:00:00-04:00", "2026-11-01T09:00:00-05:00"},
+	} {
+		setupTest(t, tc.tz)
+		baseConfig.HandoverTime = tc.handover
+		baseConfig.OpsGenie = ogConfig{APIKey: "key", ScheduleID: "schedule",
+			WeekdaySchedule: "weekday", WeekendSchedule: "weekend"}
+		useRotation(rotationConfig{})
+		og.created = nil
+
+		day, _ := parseDate(tc.date)
+		if err := setOpsgenieByDay(day, "aa@example.com", ""); err != nil {
+			t.Fatal(err)
+		}
+		if len(og.created) != 1 {
+			t.Fatalf("%d overrides created", len(og.created))
+		}
+		o := og.created[0]
+		if o.StartDate != tc.start || o.EndDate != tc.end {
+			t.Errorf("%s %s: override %s to %s, want %s to %s", tc.tz, tc.date,
+				o.StartDate, o.EndDate, tc.start, tc.end)
+		}
+	}
+}
@@ -2,21 +2,21 @@ package main
 
 import (
 	"fmt"
-  "io/ioutil"
-  "log"
-  "math/rand"
-  "path/filepath"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
-  "google.golang.org/api/calendar/v3"
-  "gopkg.in/yaml.v1"
+	"gopkg.in/yaml.v1"
 )
 
-func checkAvailability(srv *calendar.Service, day time.Time) ([]string, error) {
+func checkAvailability(cal CalendarBackend, day time.Time) ([]string, error) {
 	unavailable := []string{}
 	overloaded := []string{}
-	events, err := getDayEvents(srv, day)
+	away, err := getAwayList(cal, day)
 
 	// this operation's expensive, so only fetch restriction data when we have to.
 	if config.MaxDaysPerMonth+config.MaxWeekendsPerMonth > 0 {
@@ -25,7 +25,7 @@ func checkAvailability(srv *calendar.Service, day time.Time) ([]string, error) {
 			if *flagDebug {
 				fmt.Printf("Fetching restriction info\n")
 			}
-			restrictions.Detail = getOncallMonthRestrictions(srv, day)
+			restrictions.Detail = getOncallMonthRestrictions(cal, day)
 			restrictions.Month = day.Month()
 			restrictions.Year = day.Year()
 		}
@@ -36,8 +36,9 @@ func checkAvailability(srv *calendar.Service, day time.Time) ([]string, error) {
 			if todayOncall.Victim.Code == k {
 				continue
 			}
-			if v.DaysBooked >= config.MaxDaysPerMonth ||
-				(isWeekend(day) && v.WeekendsBooked >= config.MaxWeekendsPerMonth) {
+			person := oncallersByCode[k]
+			if v.DaysBooked >= personLimit(config.MaxDaysPerMonth, person) ||
+				(isWeekend(day) && v.WeekendsBooked >= personLimit(config.MaxWeekendsPerMonth, person)) {
 				if *flagDebug {
 					fmt.Printf("Oncaller overloaded: %s, %d/%d\n", k, v.DaysBooked, v.WeekendsBooked)
 				}
@@ -46,30 +47,65 @@ func checkAvailability(srv *calendar.Service, day time.Time) ([]string, error) {
 			}
 		}
 	}
+	unavailable = append(unavailable, away...)
+
+	// People's own restrictions (weekdays off, rest between shifts etc.)
+	for code, reason := range personalBlocks(day) {
+		if *flagDebug {
+			fmt.Printf("Oncaller blocked: %s, %s\n", code, reason)
+		}
+		unavailable = append(unavailable, strings.ToLower(code))
+	}
+
+	return uniqueCodes(unavailable), err
+}
+
+// getAwayList returns the codes of everyone marked as away in the
+// availability calendar on a given day, ignoring load restrictions.
+func getAwayList(cal CalendarBackend, day time.Time) ([]string, error) {
+	away := []string{}
+	events, err := getDayEvents(cal, day)
 	if len(events) > 0 {
 		for _, e := range events {
-			// Only look for all-day events (these have no associated time, just a date)
-			if e.Start.DateTime == "" {
+			// Only look for events taking up the whole day, usually all-day
+			// ones (these have no associated time, just a date)
+			if e.coversDay(day) {
 				title := e.Summary
 				match := holidayRE.FindStringSubmatch(title)
 				if match == nil {
 					continue
 				}
-				unavailable = append(unavailable, strings.ToLower(match[1]))
+				away = append(away, strings.ToLower(match[1]))
 			}
 		}
 	}
+	return away, err
+}
 
+// remove any duplicates
+func uniqueCodes(codes []string) []string {
 	finallist := []string{}
-	// remove any duplicates
 	j := make(map[string]bool)
-	for _, i := range unavailable {
+	for _, i := range codes {
 		if !j[i] {
 			j[i] = true
 			finallist = append(finallist, i)
 		}
 	}
-	return finallist, err
+	return finallist
+}
+
+// A day counts as a working day unless both it and the day before are
+// holidays or weekend days.
+func isWorkday(day time.Time) bool {
+	if isBusinessDay(day) == false && isBusinessDay(day.AddDate(0, 0, -1)) == false {
+		return false
+	}
+	return true
+}
+
+func isBusinessDay(day time.Time) bool {
+	return !isWeekend(day) && !isPublicHoliday(day)
 }
 
 func findNextOncall(unavailable []string, lastOncall oncallPerson,
@@ -78,7 +114,7 @@ func findNextOncall(unavailable []string, lastOncall oncallPerson,
 	nextIndex := -1
 
 	// find array index of lastOncall
-	if lastOncall == oncallerShadow {
+	if lastOncall.Code == oncallerShadow.Code {
 		// A random guess is probably as good as any..
 		lastIndex = rand.Int() % len(oncallersByOrder)
 	} else {
@@ -90,7 +126,14 @@ func findNextOncall(unavailable []string, lastOncall oncallPerson,
 		lastIndex = (lastIndex - 1) % len(oncallersByOrder)
 	}
 
-	if len(unavailable) == len(oncallersByOrder) {
+	// unavailable may mention people who aren't in the rotation at all
+	out := 0
+	for _, code := range uniqueCodes(unavailable) {
+		if _, ok := oncallersByCode[code]; ok {
+			out++
+		}
+	}
+	if out >= len(oncallersByOrder) {
 		// uh-oh, nobody is available!
 		return oncallerShadow
 	}
@@ -114,18 +157,59 @@ func findNextOncall(unavailable []string, lastOncall oncallPerson,
 	return oncallersByOrder[nextIndex]
 }
 
+// parseWeekday turns "monday", "Mon" etc. into a time.Weekday.
+func parseWeekday(name string) (time.Weekday, bool) {
+	name = strings.ToLower(name)
+	if len(name) < 3 {
+		return 0, false
+	}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.HasPrefix(strings.ToLower(d.String()), name) {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
 func unpackConfig(fn string) Config {
-  var c Config
-
-  cfgfile, _ := filepath.Abs(fn)
-  yamlfile, err := ioutil.ReadFile(cfgfile)
-  if err != nil {
-    log.Panic(err)
-  }
-
-  err = yaml.Unmarshal(yamlfile, &c)
-  if err != nil {
-    log.Panic(err)
-  }
-  return c
+	var c Config
+
+	cfgfile, _ := filepath.Abs(fn)
+	yamlfile, err := ioutil.ReadFile(cfgfile)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = yaml.Unmarshal(yamlfile, &c)
+	if err != nil {
+		log.Panic(err)
+	}
+	return c
+}
+
+// writeFileAtomic replaces path with data by writing a temporary file next
+// to it and renaming that into place, keeping the old file's permissions.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".rotator-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if st, err := os.Stat(path); err == nil {
+		os.Chmod(tmp.Name(), st.Mode())
+	} else {
+		os.Chmod(tmp.Name(), 0644)
+	}
+	return os.Rename(tmp.Name(), path)
 }
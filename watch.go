@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// "rotator watch" keeps running, and regenerates the rota whenever the
+// oncall or availability calendars change, e.g.
+//
+//	watch:
+//	  listen: ":8080"
+//	  url: https://rotator.example.com/notify
+//	  debounce: 10
+//
+// It registers a Google Calendar push channel (events.watch) for each
+// calendar, with url as the address Google posts notifications to (it has
+// to be HTTPS, and reach listen). Notifications that come in close together
+// are handled as one, debounce seconds (default 10) after the last of them,
+// with a run for the rotations using the calendars that changed. With
+// SyncCache set, those runs only regenerate the days affected. They only
+// notify anyone if the current oncaller changes. Channels are
+// renewed before they expire, and stopped when rotator is.
+type watchConfig struct {
+	Listen   string
+	URL      string
+	Debounce int
+}
+
+// watchChannel is a registered push channel for a calendar.
+type watchChannel struct {
+	ID         string
+	ResourceID string
+	Calendar   string
+	Expires    time.Time
+}
+
+// eventWatcher is implemented by backends that can push notifications of
+// changes to a calendar to address, which are sent with token.
+type eventWatcher interface {
+	WatchEvents(calendarID string, channelID string, address string, token string, ttl time.Duration) (*watchChannel, error)
+	StopWatch(channel *watchChannel) error
+}
+
+var (
+	// How long channels are asked to last, and how long before they
+	// expire they're replaced.
+	watchTTL         = 24 * time.Hour
+	watchRenewBefore = time.Hour
+	// How often expiry is checked.
+	watchCheckInterval = time.Minute
+	// Changes keep coming in? Don't wait longer than this to handle them.
+	watchMaxWait = time.Minute
+)
+
+const defaultWatchDebounce = 10
+
+type watcher struct {
+	backend eventWatcher
+	token   string
+
+	mu       sync.Mutex
+	channels map[string]*watchChannel
+	pending  map[string]bool
+	since    time.Time
+	wake     chan struct{}
+}
+
+// watchCommand handles "watch", until something arrives on stop.
+func watchCommand(backend CalendarBackend, rotations []rotationConfig, stop <-chan os.Signal) error {
+	ew, ok := backend.(eventWatcher)
+	if !ok {
+		return errors.New("watching needs the google calendar backend")
+	}
+	if config.Watch.URL == "" {
+		return errors.New("no watch url configured")
+	}
+	listen := config.Watch.Listen
+	if listen == "" {
+		listen = ":8080"
+	}
+	debounce := time.Duration(config.Watch.Debounce) * time.Second
+	if debounce <= 0 {
+		debounce = defaultWatchDebounce * time.Second
+	}
+
+	w := newWatcher(ew)
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: w}
+	go server.Serve(l)
+	defer server.Close()
+
+	for _, calendarID := range watchedCalendars(rotations) {
+		if err := w.watch(calendarID); err != nil {
+			w.stopAll()
+			return err
+		}
+	}
+	defer w.stopAll()
+	fmt.Printf("Watching %d calendars, listening on %s\n", len(w.channels), l.Addr())
+
+	// Catch up with whatever happened before we were watching.
+	watchRun(backend, rotations, nil)
+
+	renew := time.NewTicker(watchCheckInterval)
+	defer renew.Stop()
+	var due <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			fmt.Println("Stopping")
+			return nil
+		case <-w.wake:
+			due = time.After(w.delay(debounce))
+		case <-due:
+			due = nil
+			watchRun(backend, rotations, w.takePending())
+		case <-renew.C:
+			w.renew()
+		}
+	}
+}
+
+func newWatcher(backend eventWatcher) *watcher {
+	return &watcher{
+		backend:  backend,
+		token:    randomID(16),
+		channels: make(map[string]*watchChannel),
+		pending:  make(map[string]bool),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// watchedCalendars lists the calendars the rotations use, once each.
+func watchedCalendars(rotations []rotationConfig) []string {
+	var calendars []string
+	for _, r := range rotations {
+		useRotation(r)
+		for _, calendarID := range []string{config.OncallCalendar, config.AvailabilityCalendar} {
+			if !isListed(calendarID, calendars) {
+				calendars = append(calendars, calendarID)
+			}
+		}
+	}
+	return calendars
+}
+
+// watchRun is a normal run of the rotations using any of the changed
+// calendars (all of them, if changed is nil), with a fresh look at the
+// calendars and a run ID of its own. Only a change of oncaller is
+// announced, not who's on duty as such.
+func watchRun(backend CalendarBackend, rotations []rotationConfig, changed map[string]bool) {
+	runID = newRunID()
+	journaled = 0
+	failures = nil
+	syncCache = syncCacheFile{}
+	syncChanges = make(map[string]map[string]bool)
+	cal := newJournalBackend(newCacheBackend(backend))
+
+	for _, r := range rotations {
+		useRotation(r)
+		if changed != nil && !changed[config.OncallCalendar] && !changed[config.AvailabilityCalendar] {
+			continue
+		}
+		if *flagVerbose {
+			fmt.Printf("Regenerating %s (run %s)\n", describeRotation(r.Name), runID)
+		}
+		current, err := oncallAt(cal, rotaNow())
+		if err != nil {
+			if failDay(time.Time{}, "calendar", err) != nil {
+				break
+			}
+			continue
+		}
+		err = generateRota(cal, r.Name, current.Victim, false)
+		if err != nil && err != errStopped {
+			err = failDay(time.Time{}, "calendar", err)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if err := saveState(); err != nil {
+		fmt.Printf("Error saving state file: %s\n", err)
+	}
+	if err := saveSyncCache(); err != nil {
+		fmt.Printf("Error saving sync cache: %s\n", err)
+	}
+	journalSummary()
+	retrySummary()
+	if len(failures) > 0 {
+		failureSummary()
+	}
+}
+
+func describeRotation(name string) string {
+	if name == "" {
+		return "the rota"
+	}
+	return name
+}
+
+// ServeHTTP takes notifications from the push channels.
+func (w *watcher) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	id := req.Header.Get("X-Goog-Channel-ID")
+	w.mu.Lock()
+	channel, ok := w.channels[id]
+	w.mu.Unlock()
+	if !ok || req.Header.Get("X-Goog-Channel-Token") != w.token {
+		http.NotFound(rw, req)
+		return
+	}
+	// "sync" just confirms a new channel; "exists" means a change.
+	state := req.Header.Get("X-Goog-Resource-State")
+	if *flagDebug {
+		fmt.Printf("Notification for %s: %s\n", channel.Calendar, state)
+	}
+	if state != "sync" {
+		w.notify(channel.Calendar)
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+func (w *watcher) notify(calendarID string) {
+	w.mu.Lock()
+	if len(w.pending) == 0 {
+		w.since = time.Now()
+	}
+	w.pending[calendarID] = true
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// started is when the oldest change not yet handled came in.
+func (w *watcher) started() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.since
+}
+
+// delay is how long to wait before handling the changes pending: debounce
+// after the last of them, but no longer than watchMaxWait after the first.
+func (w *watcher) delay(debounce time.Duration) time.Duration {
+	wait := debounce
+	if left := time.Until(w.started().Add(watchMaxWait)); left < wait {
+		wait = left
+	}
+	return wait
+}
+
+func (w *watcher) takePending() map[string]bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	changed := w.pending
+	w.pending = make(map[string]bool)
+	return changed
+}
+
+func (w *watcher) watch(calendarID string) error {
+	channel, err := w.backend.WatchEvents(calendarID, "rotator-"+randomID(8), config.Watch.URL, w.token, watchTTL)
+	if err != nil {
+		return fmt.Errorf("unable to watch %s: %s", calendarID, err)
+	}
+	if *flagVerbose {
+		fmt.Printf("Watching %s until %s\n", calendarID, channel.Expires.Format(time.RFC3339))
+	}
+	w.mu.Lock()
+	w.channels[channel.ID] = channel
+	w.mu.Unlock()
+	return nil
+}
+
+// renew replaces channels that are about to expire. The old one is only
+// stopped once the new one is there, so no changes go unnoticed.
+func (w *watcher) renew() {
+	w.mu.Lock()
+	var expiring []*watchChannel
+	for _, channel := range w.channels {
+		if time.Until(channel.Expires) < watchRenewBefore {
+			expiring = append(expiring, channel)
+		}
+	}
+	w.mu.Unlock()
+	for _, channel := range expiring {
+		if err := w.watch(channel.Calendar); err != nil {
+			// try again next time round
+			fmt.Printf("Error: %s\n", err)
+			continue
+		}
+		w.stop(channel)
+	}
+}
+
+func (w *watcher) stop(channel *watchChannel) {
+	if err := w.backend.StopWatch(channel); err != nil {
+		fmt.Printf("Error stopping channel for %s: %s\n", channel.Calendar, err)
+	}
+	w.mu.Lock()
+	delete(w.channels, channel.ID)
+	w.mu.Unlock()
+}
+
+func (w *watcher) stopAll() {
+	w.mu.Lock()
+	var channels []*watchChannel
+	for _, channel := range w.channels {
+		channels = append(channels, channel)
+	}
+	w.mu.Unlock()
+	for _, channel := range channels {
+		w.stop(channel)
+	}
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
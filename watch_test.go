@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeWatcher hands out push channels, and keeps those not stopped yet.
+type fakeWatcher struct {
+	channels map[string]*watchChannel
+	stopped  []string
+	fail     error
+}
+
+func newFakeWatcher() *fakeWatcher {
+	return &fakeWatcher{channels: make(map[string]*watchChannel)}
+}
+
+func (f *fakeWatcher) WatchEvents(calendarID string, channelID string, address string, token string, ttl time.Duration) (*watchChannel, error) {
+	if f.fail != nil {
+		return nil, f.fail
+	}
+	channel := &watchChannel{ID: channelID, ResourceID: "resource-" + calendarID,
+		Calendar: calendarID, Expires: time.Now().Add(ttl)}
+	f.channels[channelID] = channel
+	return channel, nil
+}
+
+func (f *fakeWatcher) StopWatch(channel *watchChannel) error {
+	delete(f.channels, channel.ID)
+	f.stopped = append(f.stopped, channel.ID)
+	return nil
+}
+
+func (f *fakeWatcher) channelFor(calendarID string) *watchChannel {
+	for _, channel := range f.channels {
+		if channel.Calendar == calendarID {
+			return channel
+		}
+	}
+	return nil
+}
+
+// setupWatcher watches "oncall" and "away", with a server taking the
+// notifications for them.
+func setupWatcher(t *testing.T) (*fakeWatcher, *watcher, *httptest.Server) {
+	setupTest(t, "Europe/Vienna")
+	f := newFakeWatcher()
+	w := newWatcher(f)
+	for _, calendarID := range []string{"oncall", "away"} {
+		if err := w.watch(calendarID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewServer(w)
+	t.Cleanup(srv.Close)
+	return f, w, srv
+}
+
+// pushNotification posts what Google would for a change on channelID.
+func pushNotification(t *testing.T, srv *httptest.Server, channelID string, token string, state string) int {
+	req, _ := http.NewRequest("POST", srv.URL+"/notify", nil)
+	req.Header.Set("X-Goog-Channel-ID", channelID)
+	req.Header.Set("X-Goog-Channel-Token", token)
+	req.Header.Set("X-Goog-Resource-ID", "resource")
+	req.Header.Set("X-Goog-Resource-State", state)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestWatchNotifications(t *testing.T) {
+	f, w, srv := setupWatcher(t)
+	away := f.channelFor("away").ID
+
+	for _, tc := range []struct {
+		channel string
+		token   string
+		state   string
+		code    int
+	}{
+		{away, "wrong", "exists", http.StatusNotFound},
+		{away, "", "exists", http.StatusNotFound},
+		{"rotator-unknown", w.token, "exists", http.StatusNotFound},
+		// a new channel saying hello
+		{away, w.token, "sync", http.StatusOK},
+	} {
+		if code := pushNotification(t, srv, tc.channel, tc.token, tc.state); code != tc.code {
+			t.Errorf("%s with token %q, %s: got %d, want %d", tc.channel, tc.token, tc.state, code, tc.code)
+		}
+	}
+	if pending := w.takePending(); len(pending) != 0 {
+		t.Fatalf("pending after no changes: %v", pending)
+	}
+
+	if code := pushNotification(t, srv, away, w.token, "exists"); code != http.StatusOK {
+		t.Fatalf("change: got %d", code)
+	}
+	if pending := w.takePending(); len(pending) != 1 || !pending["away"] {
+		t.Errorf("pending: %v", pending)
+	}
+}
+
+func TestWatchCoalesces(t *testing.T) {
+	f, w, srv := setupWatcher(t)
+	saved := watchMaxWait
+	watchMaxWait = 200 * time.Millisecond
+	defer func() { watchMaxWait = saved }()
+
+	pushNotification(t, srv, f.channelFor("away").ID, w.token, "exists")
+	first := w.started()
+	if wait := w.delay(100 * time.Millisecond); wait <= 50*time.Millisecond || wait > 100*time.Millisecond {
+		t.Errorf("first change: waiting %s, want the debounce", wait)
+	}
+
+	// More changes keep coming in, but the first one has waited long
+	// enough.
+	time.Sleep(150 * time.Millisecond)
+	pushNotification(t, srv, f.channelFor("away").ID, w.token, "exists")
+	pushNotification(t, srv, f.channelFor("oncall").ID, w.token, "exists")
+	if !w.started().Equal(first) {
+		t.Errorf("started %s, want the first change at %s", w.started(), first)
+	}
+	if wait := w.delay(100 * time.Millisecond); wait > 50*time.Millisecond {
+		t.Errorf("waiting %s after the first change, max wait is %s", wait, watchMaxWait)
+	}
+	if len(w.wake) != 1 {
+		t.Errorf("%d wakeups queued, want 1", len(w.wake))
+	}
+
+	// and they're all handled in the one run
+	if pending := w.takePending(); len(pending) != 2 || !pending["away"] || !pending["oncall"] {
+		t.Errorf("pending: %v", pending)
+	}
+	if pending := w.takePending(); len(pending) != 0 {
+		t.Errorf("still pending: %v", pending)
+	}
+
+	// A change after that starts waiting afresh.
+	pushNotification(t, srv, f.channelFor("away").ID, w.token, "exists")
+	if !w.started().After(first) {
+		t.Errorf("started %s, not after the changes handled", w.started())
+	}
+}
+
+func TestWatchRenew(t *testing.T) {
+	f, w, srv := setupWatcher(t)
+	old := f.channelFor("oncall")
+	old.Expires = time.Now().Add(watchRenewBefore / 2)
+	keep := f.channelFor("away")
+
+	// Not while Google won't give us a new one.
+	f.fail = errors.New("quota exceeded")
+	w.renew()
+	if len(f.stopped) != 0 || w.channels[old.ID] == nil {
+		t.Fatalf("expiring channel stopped without a new one: %v", f.stopped)
+	}
+
+	f.fail = nil
+	w.renew()
+	if len(f.stopped) != 1 || f.stopped[0] != old.ID {
+		t.Errorf("stopped %v, want just %s", f.stopped, old.ID)
+	}
+	renewed := f.channelFor("oncall")
+	if renewed == nil || renewed.ID == old.ID || w.channels[renewed.ID] == nil {
+		t.Fatalf("oncall not renewed: %+v", renewed)
+	}
+	if time.Until(renewed.Expires) < watchTTL-time.Minute {
+		t.Errorf("renewed channel expires %s", renewed.Expires)
+	}
+	if len(w.channels) != 2 || w.channels[keep.ID] == nil {
+		t.Errorf("channels: %v", w.channels)
+	}
+
+	// Notifications only count on the new channel.
+	if code := pushNotification(t, srv, old.ID, w.token, "exists"); code != http.StatusNotFound {
+		t.Errorf("old channel: got %d", code)
+	}
+	if code := pushNotification(t, srv, renewed.ID, w.token, "exists"); code != http.StatusOK {
+		t.Errorf("new channel: got %d", code)
+	}
+	if pending := w.takePending(); len(pending) != 1 || !pending["oncall"] {
+		t.Errorf("pending: %v", pending)
+	}
+}
+
+// notifications lists what a plan would have sent.
+func notifications(plan *rotaPlan) []string {
+	var sent []string
+	for _, op := range plan.Ops {
+		switch op.Kind {
+		case "mail":
+			sent = append(sent, "mail: "+op.Mail.Subject)
+		case "slack", "slack-dm":
+			sent = append(sent, op.Kind+": "+op.Message)
+		}
+	}
+	return sent
+}
+
+func TestWatchRunOnlyAnnouncesChanges(t *testing.T) {
+	f := setupTest(t, "Europe/Vienna")
+	baseConfig.SlackKey = "key"
+	baseConfig.SlackChannel = "#oncall"
+	baseConfig.SlackEmergency = true
+	for i := range baseConfig.Oncallers {
+		baseConfig.Oncallers[i].Email = baseConfig.Oncallers[i].Code + "@example.com"
+	}
+	useRotation(rotationConfig{})
+	savedSlack, savedNotify := *notifySlack, *notifyVictim
+	*notifySlack, *notifyVictim = true, "today"
+	activePlan = &rotaPlan{}
+	defer func() {
+		*notifySlack, *notifyVictim = savedSlack, savedNotify
+		activePlan = nil
+	}()
+
+	// Nobody's on duty yet, so there's someone new to announce.
+	watchRun(f, []rotationConfig{{}}, nil)
+	sent := notifications(activePlan)
+	if len(sent) != 3 {
+		t.Errorf("first run sent %q, want the change announced", sent)
+	}
+	for _, s := range sent {
+		if strings.Contains(s, "Reminder") || strings.Contains(s, "currently on duty") {
+			t.Errorf("first run sent a reminder: %q", s)
+		}
+	}
+
+	// Same oncaller, nothing to say.
+	activePlan.Ops = nil
+	watchRun(f, []rotationConfig{{}}, nil)
+	if sent := notifications(activePlan); len(sent) != 0 {
+		t.Errorf("second run sent %q", sent)
+	}
+}